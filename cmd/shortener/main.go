@@ -12,8 +12,10 @@ import (
 
 func main() {
 	cnf := server.NewConfig()
-	cnf.Parse()
-	
+	if err := cnf.Parse(); err != nil {
+		log.Fatal(err)
+	}
+
 	srv, err := server.New(cnf)
 	if err != nil {
 		log.Fatal(err)
@@ -28,8 +30,7 @@ func main() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 	<-quit
-	srv.Shutdown()
-	if err != nil {
+	if err := srv.Shutdown(); err != nil {
 		log.Fatal(err)
 	}
 }
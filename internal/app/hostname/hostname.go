@@ -0,0 +1,42 @@
+package hostname
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Host names are converted to punycode (IDNA) leniently, as browsers do: the strict
+// lookup profile rejects hosts which are in real use, e.g. the ones with '--' in the
+// 3rd and 4th positions (r4---sn-abc.googlevideo.com) or with underscores
+// (my_host.example.com). The labels still must be made of letters, digits, hyphens
+// and underscores, and must not start or end with a hyphen.
+
+var profile = idna.New(
+	idna.MapForLookup(),
+	idna.Transitional(false),
+	idna.StrictDomainName(false),
+	idna.CheckHyphens(false),
+)
+
+// ToASCII() converts the host name to punycode in lower case, the root dot (if any)
+// must be trimmed by the caller
+
+func ToASCII(host string) (string, error) {
+	ascii, err := profile.ToASCII(host)
+	if err != nil {
+		return "", err
+	}
+	for _, label := range strings.Split(ascii, ".") {
+		if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return "", fmt.Errorf("label %q starts or ends with a hyphen", label)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return "", fmt.Errorf("label %q contains %q", label, c)
+			}
+		}
+	}
+	return ascii, nil
+}
@@ -0,0 +1,29 @@
+package hostname
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToASCII(t *testing.T) {
+	for host, want := range map[string]string{
+		"www.google.com":                   "www.google.com",
+		"WWW.Google.COM":                   "www.google.com",
+		"Яндекс.РФ":                        "xn--d1acpjx3f.xn--p1ai",
+		"r4---sn-4g5e6nzl.googlevideo.com": "r4---sn-4g5e6nzl.googlevideo.com",
+		"ab--cd.example.com":               "ab--cd.example.com",
+		"my_host.example.com":              "my_host.example.com",
+		"_dmarc.example.com":               "_dmarc.example.com",
+	} {
+		got, err := ToASCII(host)
+		require.NoError(t, err, host)
+		assert.Equal(t, want, got, host)
+	}
+
+	for _, host := range []string{"-a.com", "a-.com", "xn--a.com", "a!b.com", "a b.com", "a/b.com"} {
+		_, err := ToASCII(host)
+		assert.Error(t, err, host)
+	}
+}
@@ -0,0 +1,259 @@
+package policy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nickeroshenkov/urlShortener/internal/app/hostname"
+)
+
+// Policy tells which full URLs may be shortened and followed. It checks them against
+// two lists of rules read from files: a URL is denied if it matches the blocklist, or
+// if the allowlist has any rules and the URL matches none of them. Each line of a file
+// is a rule (empty lines and the ones starting with '#' are skipped):
+// - example.com is the exact host
+// - *.example.com is any subdomain of the host (but not the host itself)
+// - /regexp/ is a regular expression matched against the whole URL
+// - 10.0.0.0/8 is a CIDR range for the hosts which are IP addresses
+//
+// The files are checked for changes periodically and read again once they change. If
+// a file cannot be read or has a bad rule, the former rules stay in force.
+
+var ErrDenied = errors.New("URL is denied by the policy")
+
+type Policy struct {
+	block *list
+	allow *list
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// New() reads the files, an empty path means no such list. Zero reload interval
+// disables the reloads.
+
+func New(blocklist, allowlist string, reloadEvery time.Duration) (*Policy, error) {
+	p := &Policy{done: make(chan struct{})}
+	var err error
+	if p.block, err = newList(blocklist); err != nil {
+		return nil, err
+	}
+	if p.allow, err = newList(allowlist); err != nil {
+		return nil, err
+	}
+	if reloadEvery > 0 {
+		p.wg.Add(1)
+		go p.reloader(reloadEvery)
+	}
+	return p, nil
+}
+
+// Check() returns ErrDenied (with the reason) if the URL is denied
+
+func (p *Policy) Check(rawURL string) error {
+	// URLs stored long ago may be malformed, only regexps are matched against them then.
+	// The root dot is dropped, as example.com. is the same host as example.com.
+	//
+	var host string
+	if u, err := url.Parse(rawURL); err == nil {
+		host = strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	}
+	if ascii, err := hostname.ToASCII(host); err == nil {
+		host = ascii
+	}
+	if rule, ok := p.block.get().match(rawURL, host); ok {
+		return fmt.Errorf("%w: it matches %q in the blocklist", ErrDenied, rule)
+	}
+	if allow := p.allow.get(); !allow.empty() {
+		if _, ok := allow.match(rawURL, host); !ok {
+			return fmt.Errorf("%w: it matches nothing in the allowlist", ErrDenied)
+		}
+	}
+	return nil
+}
+
+func (p *Policy) reloader(every time.Duration) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			for _, l := range []*list{p.block, p.allow} {
+				if err := l.reload(); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}
+}
+
+// Close() stops the reloads
+
+func (p *Policy) Close() {
+	close(p.done)
+	p.wg.Wait()
+}
+
+// list keeps the rules of a file along with the file state they have been read at. The
+// rules are swapped as a whole, so checks never see a half-read file.
+
+type list struct {
+	path    string
+	rules   atomic.Pointer[rules]
+	modTime time.Time
+	size    int64
+}
+
+func newList(path string) (*list, error) {
+	l := &list{path: path}
+	l.rules.Store(&rules{})
+	if path == "" {
+		return l, nil
+	}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *list) get() *rules {
+	return l.rules.Load()
+}
+
+// reload() reads the file if it has changed since the last time, it is only called by
+// one goroutine at a time
+
+func (l *list) reload() error {
+	if l.path == "" {
+		return nil
+	}
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return fmt.Errorf("error reading the policy: %w", err)
+	}
+	if info.ModTime().Equal(l.modTime) && info.Size() == l.size {
+		return nil
+	}
+	// The bad file is not read again (and not reported again) until it changes
+	//
+	l.modTime, l.size = info.ModTime(), info.Size()
+	r, err := readRules(l.path)
+	if err != nil {
+		return err
+	}
+	l.rules.Store(r)
+	return nil
+}
+
+type rules struct {
+	hosts   map[string]string // exact hosts to the rules
+	domains map[string]string // parent domains of the subdomains to the rules
+	regexps []*regexp.Regexp
+	nets    []*net.IPNet
+}
+
+func (r *rules) empty() bool {
+	return len(r.hosts) == 0 && len(r.domains) == 0 && len(r.regexps) == 0 && len(r.nets) == 0
+}
+
+// match() gives the rule the URL matches. The host must be in the canonical form:
+// in lower case and in punycode.
+
+func (r *rules) match(rawURL, host string) (string, bool) {
+	if rule, ok := r.hosts[host]; ok {
+		return rule, true
+	}
+	for parent := host; ; {
+		_, rest, ok := strings.Cut(parent, ".")
+		if !ok {
+			break
+		}
+		if rule, ok := r.domains[rest]; ok {
+			return rule, true
+		}
+		parent = rest
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, n := range r.nets {
+			if n.Contains(ip) {
+				return n.String(), true
+			}
+		}
+	}
+	for _, re := range r.regexps {
+		if re.MatchString(rawURL) {
+			return "/" + re.String() + "/", true
+		}
+	}
+	return "", false
+}
+
+func readRules(path string) (*rules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the policy: %w", err)
+	}
+	defer f.Close()
+	r := &rules{hosts: map[string]string{}, domains: map[string]string{}}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := r.add(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: bad rule %q: %w", path, n, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading the policy: %w", err)
+	}
+	return r, nil
+}
+
+func (r *rules) add(rule string) error {
+	switch {
+	case len(rule) >= 2 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/"):
+		re, err := regexp.Compile(rule[1 : len(rule)-1])
+		if err != nil {
+			return err
+		}
+		r.regexps = append(r.regexps, re)
+	case strings.Contains(rule, "/"):
+		_, n, err := net.ParseCIDR(rule)
+		if err != nil {
+			return err
+		}
+		r.nets = append(r.nets, n)
+	case strings.HasPrefix(rule, "*."):
+		domain, err := hostname.ToASCII(strings.TrimSuffix(rule[2:], "."))
+		if err != nil {
+			return err
+		}
+		r.domains[domain] = rule
+	default:
+		host := strings.Trim(rule, "[]")
+		if ip := net.ParseIP(host); ip != nil {
+			r.hosts[strings.ToLower(host)] = rule
+			return nil
+		}
+		host, err := hostname.ToASCII(strings.TrimSuffix(host, "."))
+		if err != nil {
+			return err
+		}
+		r.hosts[host] = rule
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeRules() writes the rules to the file in a temporary directory
+
+func writeRules(t *testing.T, filename, rules string) string {
+	filename = filepath.Join(t.TempDir(), filename)
+	require.NoError(t, os.WriteFile(filename, []byte(rules), 0664))
+	return filename
+}
+
+func TestCheck(t *testing.T) {
+	block := writeRules(t, "block.txt", `
+# Hosts, subdomains, regexps and IP ranges
+evil.com
+*.bad.org
+worse.net.
+*.worst.io.
+Пример.рф
+r4---sn-evil.example
+*.my_bad.org
+/^https?://[^/]+/phish/
+10.0.0.0/8
+[2001:db8::1]
+`)
+	p, err := New(block, "", 0)
+	require.NoError(t, err)
+	defer p.Close()
+
+	for url, denied := range map[string]bool{
+		"http://evil.com/page":            true,
+		"https://EVIL.com":                true,
+		"http://www.evil.com":             false,
+		"http://notevil.com":              false,
+		"http://www.bad.org":              true,
+		"http://a.b.bad.org/x":            true,
+		"http://bad.org":                  false,
+		"http://xn--e1afmkfd.xn--p1ai":    true,
+		"http://пример.рф/путь":           true,
+		"http://good.com/phish/x":         true,
+		"http://good.com/x/phish/":        false,
+		"http://10.1.2.3:8080/":           true,
+		"http://11.1.2.3/":                false,
+		"http://[2001:DB8::1]/":           true,
+		"http://[2001:db8::2]/":           false,
+		"http://www.google.com/?q=phish/": false,
+		"http://evil.com./page":           true,
+		"http://EVIL.COM.:8080":           true,
+		"http://x.bad.org.":               true,
+		"http://bad.org.":                 false,
+		"http://worse.net":                true,
+		"http://worse.net.":               true,
+		"http://a.worst.io":               true,
+		"http://a.worst.io.":              true,
+		"http://R4---sn-evil.example/x":   true,
+		"http://r4---sn-good.example":     false,
+		"http://a.my_bad.org":             true,
+		"http://a.my_good.org":            false,
+	} {
+		err := p.Check(url)
+		if denied {
+			assert.ErrorIs(t, err, ErrDenied, url)
+		} else {
+			assert.NoError(t, err, url)
+		}
+	}
+	err = p.Check("http://www.bad.org")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `"*.bad.org"`)
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	block := writeRules(t, "block.txt", "private.example.com\n")
+	allow := writeRules(t, "allow.txt", "example.com\n*.example.com\n")
+	p, err := New(block, allow, 0)
+	require.NoError(t, err)
+	defer p.Close()
+
+	assert.NoError(t, p.Check("http://example.com"))
+	assert.NoError(t, p.Check("http://www.example.com"))
+	assert.ErrorIs(t, p.Check("http://www.google.com"), ErrDenied)
+
+	// The blocklist wins over the allowlist
+	//
+	assert.ErrorIs(t, p.Check("http://private.example.com"), ErrDenied)
+
+	// An allowlist without rules allows all
+	//
+	empty := writeRules(t, "allow.txt", "# Nothing yet\n")
+	p2, err := New("", empty, 0)
+	require.NoError(t, err)
+	defer p2.Close()
+	assert.NoError(t, p2.Check("http://www.google.com"))
+}
+
+func TestBadRules(t *testing.T) {
+	for _, rules := range []string{"/(/\n", "10.0.0.0/33\n", "*.-bad.com\n", "bad host\n"} {
+		_, err := New(writeRules(t, "block.txt", rules), "", 0)
+		assert.Error(t, err, rules)
+	}
+	_, err := New(filepath.Join(t.TempDir(), "missing.txt"), "", 0)
+	assert.Error(t, err)
+}
+
+func TestReload(t *testing.T) {
+	block := writeRules(t, "block.txt", "evil.com\n")
+	p, err := New(block, "", 10*time.Millisecond)
+	require.NoError(t, err)
+	defer p.Close()
+	require.ErrorIs(t, p.Check("http://evil.com"), ErrDenied)
+	require.NoError(t, p.Check("http://www.google.com"))
+
+	// The changed file is read again
+	//
+	require.NoError(t, os.WriteFile(block, []byte("evil.com\nwww.google.com\n"), 0664))
+	assert.Eventually(t, func() bool {
+		return p.Check("http://www.google.com") != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The bad file keeps the former rules in force
+	//
+	require.NoError(t, os.WriteFile(block, []byte("/(/\n"), 0664))
+	time.Sleep(100 * time.Millisecond)
+	assert.ErrorIs(t, p.Check("http://evil.com"), ErrDenied)
+	assert.ErrorIs(t, p.Check("http://www.google.com"), ErrDenied)
+
+	// And so does the removed one
+	//
+	require.NoError(t, os.Remove(block))
+	time.Sleep(100 * time.Millisecond)
+	assert.ErrorIs(t, p.Check("http://evil.com"), ErrDenied)
+}
@@ -0,0 +1,48 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Aliases are short URLs given by users. They are made of Latin letters, digits, '-'
+// and '_', and must not be any of the first path segments the router serves (e.g.
+// "api" or "ping"), in any case, as such a short URL could never be reached. The store
+// is told not to generate them either.
+
+const (
+	minAliasLength = 3
+	maxAliasLength = 64
+)
+
+// reservedAliases() collects the first segments of the router paths
+
+func reservedAliases(routes chi.Routes) map[string]bool {
+	reserved := map[string]bool{}
+	chi.Walk(routes, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		segment, _, _ := strings.Cut(strings.TrimPrefix(route, "/"), "/")
+		if segment != "" && !strings.HasPrefix(segment, "{") {
+			reserved[strings.ToLower(segment)] = true
+		}
+		return nil
+	})
+	return reserved
+}
+
+func (rou URLRouter) validAlias(alias string) error {
+	if len(alias) < minAliasLength || len(alias) > maxAliasLength {
+		return fmt.Errorf("alias must be from %d to %d characters long", minAliasLength, maxAliasLength)
+	}
+	for _, c := range alias {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("alias must not contain %q", c)
+		}
+	}
+	if rou.reserved[strings.ToLower(alias)] {
+		return fmt.Errorf("alias %q is reserved", alias)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package router
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/nickeroshenkov/urlShortener/internal/app/storage"
+)
+
+// Programmatic clients authenticate with API keys sent in the Authorization header as
+// bearer tokens. A key is its ID and a random secret separated by a dot, and the store
+// keeps only the SHA-256 hash of the whole key (the secret is long and random, so a
+// plain hash is enough). A request with a valid key acts for the owner of the key and
+// gets no cookie, and a request with an invalid (or revoked) key is rejected. Requests
+// without the header are left to Authenticate().
+//
+// The scope of a key tells what it may be used for: adding links, reading the links,
+// their statistics and history, or anything (admin). Only admin keys manage the keys,
+// and the first of them is the one set in the server configuration, which acts for the
+// admin owner.
+
+const (
+	ScopeCreate = "create"
+	ScopeStats  = "stats"
+	ScopeAdmin  = "admin"
+)
+
+const (
+	headerAuthorization = "Authorization"
+	headerAuthenticate  = "WWW-Authenticate"
+	bearerScheme        = "Bearer"
+	adminOwner          = "admin"
+	keyIDLength         = 8
+	keySecretLength     = 32
+)
+
+const (
+	errKeyInvalid  = "API key is invalid"
+	errKeyRequired = "API key with the admin scope is required"
+	errKeyScope    = "API key scope %q does not allow this request"
+	errKeyMissing  = "API key does not exist"
+	errKeyCheck    = "error checking the API key"
+	errScope       = "Scope must be create, stats or admin"
+)
+
+var scopes = map[string]bool{ScopeCreate: true, ScopeStats: true, ScopeAdmin: true}
+
+// AuthenticateKey() must go before Authenticate(). The admin key is the one set in the
+// configuration, an empty one means none.
+
+func AuthenticateKey(s storage.URLStorer, adminKey string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get(headerAuthorization)
+			if header == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			token := strings.TrimPrefix(header, bearerScheme+" ")
+			if token == header || token == "" {
+				unauthorized(w, errKeyInvalid)
+				return
+			}
+			var key storage.APIKey
+			if adminKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminKey)) == 1 {
+				key = storage.APIKey{Owner: adminOwner, Scope: ScopeAdmin}
+			} else {
+				var err error
+				key, err = s.GetKey(r.Context(), hashKey(token))
+				switch {
+				case errors.Is(err, storage.ErrNotFound) || err == nil && key.Revoked:
+					unauthorized(w, errKeyInvalid)
+					return
+				case err != nil:
+					storageError(w, fmt.Errorf("%s: %w", errKeyCheck, err))
+					return
+				}
+			}
+			ctx := context.WithValue(r.Context(), keyUserID, key.Owner)
+			ctx = context.WithValue(ctx, keyScope, key.Scope)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// scope() gives the scope of the API key set by AuthenticateKey(), or an empty string
+// if the request has none
+
+func scope(ctx context.Context) string {
+	s, _ := ctx.Value(keyScope).(string)
+	return s
+}
+
+func hashKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func unauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set(headerAuthenticate, bearerScheme)
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+// scoped() gives the middleware which lets the requests with API keys through only if
+// the key has the scope (admin keys have all of them). The requests without keys are
+// let through unless the keys are required.
+
+func scoped(s string, keysOnly bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			switch got := scope(r.Context()); {
+			case got == "" && keysOnly:
+				unauthorized(w, errKeyRequired)
+			case got != "" && got != s && got != ScopeAdmin:
+				http.Error(w, fmt.Sprintf(errKeyScope, got), http.StatusForbidden)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// newKey() makes a new API key, it gives the key itself along with the record to store
+
+func newKey(owner, scope string) (string, storage.APIKey, error) {
+	id := make([]byte, keyIDLength)
+	secret := make([]byte, keySecretLength)
+	if _, err := rand.Read(id); err != nil {
+		return "", storage.APIKey{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", storage.APIKey{}, err
+	}
+	key := storage.APIKey{
+		ID:        hex.EncodeToString(id),
+		Owner:     owner,
+		Scope:     scope,
+		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	token := key.ID + "." + base64.RawURLEncoding.EncodeToString(secret)
+	key.Hash = hashKey(token)
+	return token, key, nil
+}
+
+type keyItem struct {
+	ID        string    `json:"id"`
+	Key       string    `json:"key,omitempty"`
+	Owner     string    `json:"owner"`
+	Scope     string    `json:"scope"`
+	CreatedAt time.Time `json:"created_at"`
+	Revoked   bool      `json:"revoked"`
+}
+
+func newKeyItem(key storage.APIKey) keyItem {
+	return keyItem{ID: key.ID, Owner: key.Owner, Scope: key.Scope, CreatedAt: key.CreatedAt.UTC(), Revoked: key.Revoked}
+}
+
+// addKey() issues a new API key, which is replied only this once. A key without the
+// owner acts for a new user.
+
+func (rou URLRouter) addKey(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Owner string `json:"owner"`
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if !scopes[request.Scope] {
+		http.Error(w, errScope, http.StatusBadRequest)
+		return
+	}
+	if request.Owner == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		request.Owner = hex.EncodeToString(b)
+	}
+	token, key, err := newKey(request.Owner, request.Scope)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := rou.storer.AddKey(r.Context(), key); err != nil {
+		storageError(w, err)
+		return
+	}
+	response := newKeyItem(key)
+	response.Key = token
+	w.Header().Set(headerContentType, "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// getKeys() replies with all the API keys (without the keys themselves)
+
+func (rou URLRouter) getKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := rou.storer.ListKeys(r.Context())
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	response := make([]keyItem, len(keys))
+	for i, key := range keys {
+		response[i] = newKeyItem(key)
+	}
+	w.Header().Set(headerContentType, "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// revokeKey() revokes the API key for good
+
+func (rou URLRouter) revokeKey(w http.ResponseWriter, r *http.Request) {
+	err := rou.storer.RevokeKey(r.Context(), chi.URLParam(r, "id"))
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, errKeyMissing, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,136 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nickeroshenkov/urlShortener/internal/app/storage"
+)
+
+const testAdminKey = "root-key"
+
+func TestAPIKeys(t *testing.T) {
+	store := urlStoreMock{i: 0, s: map[string]string{}, o: map[string]string{}}
+	router := chi.NewRouter()
+	router.Use(AuthenticateKey(&store, testAdminKey))
+	router.Use(Authenticate(testKey))
+	New("http://localhost:8080", router, &store)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	request := func(method, path, key, body string) (*http.Response, string) {
+		return send(t, method, server.URL+path, body, nil, headerAuthorization, key)
+	}
+	issue := func(owner, scope string) keyItem {
+		response, body := request(http.MethodPost, "/api/admin/keys", "Bearer "+testAdminKey, `{"owner":"`+owner+`","scope":"`+scope+`"}`)
+		require.Equal(t, http.StatusCreated, response.StatusCode, body)
+		var item keyItem
+		require.NoError(t, json.Unmarshal([]byte(body), &item))
+		return item
+	}
+
+	// Keys are managed with admin keys only
+	//
+	response, _ := request(http.MethodGet, "/api/admin/keys", "", "")
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	assert.Equal(t, bearerScheme, response.Header.Get(headerAuthenticate))
+	response, _ = request(http.MethodPost, "/api/admin/keys", "Bearer "+testAdminKey, `{"scope":"everything"}`)
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	creator := issue("user1", ScopeCreate)
+	reader := issue("user1", ScopeStats)
+	admin := issue("", ScopeAdmin)
+	assert.Equal(t, "user1", creator.Owner)
+	assert.NotEmpty(t, admin.Owner)
+	assert.True(t, strings.HasPrefix(creator.Key, creator.ID+"."))
+	require.Len(t, store.k, 3)
+	assert.Equal(t, hashKey(creator.Key), store.k[0].Hash)
+	response, _ = request(http.MethodGet, "/api/admin/keys", "Bearer "+creator.Key, "")
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+
+	// The list has no keys themselves
+	//
+	response, body := request(http.MethodGet, "/api/admin/keys", "Bearer "+admin.Key, "")
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	var items []keyItem
+	require.NoError(t, json.Unmarshal([]byte(body), &items))
+	require.Len(t, items, 3)
+	assert.Equal(t, creator.ID, items[0].ID)
+	assert.Empty(t, items[0].Key)
+	assert.NotContains(t, body, creator.Key)
+
+	// Keys act for their owners without cookies, within their scopes
+	//
+	response, _ = request(http.MethodPost, "/api/shorten", "Bearer "+creator.Key, `{"url":"http://www.google.com"}`)
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	assert.Empty(t, response.Cookies())
+	assert.Equal(t, map[string]string{"1": "user1"}, store.o)
+	response, _ = request(http.MethodGet, "/api/user/urls", "Bearer "+creator.Key, "")
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+	response, _ = request(http.MethodGet, "/api/user/urls", "Bearer "+reader.Key, "")
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	response, _ = request(http.MethodPost, "/", "Bearer "+reader.Key, "http://www.yandex.ru")
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+	response, _ = request(http.MethodDelete, "/api/user/urls", "Bearer "+reader.Key, `["1"]`)
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+	response, _ = request(http.MethodPost, "/", "Bearer "+admin.Key, "http://www.yandex.ru")
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+
+	// Cookies still work for everything but the keys
+	//
+	response, _ = request(http.MethodPost, "/", "", "http://www.mail.ru")
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	assert.NotEmpty(t, response.Cookies())
+
+	// Invalid and revoked keys are rejected
+	//
+	for _, header := range []string{"Bearer wrong", "Bearer ", "Basic " + creator.Key, creator.Key} {
+		response, _ = request(http.MethodPost, "/", header, "http://www.bing.com")
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode, header)
+	}
+	response, _ = request(http.MethodDelete, "/api/admin/keys/"+creator.ID, "Bearer "+admin.Key, "")
+	assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	response, _ = request(http.MethodDelete, "/api/admin/keys/missing", "Bearer "+admin.Key, "")
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	response, _ = request(http.MethodPost, "/", "Bearer "+creator.Key, "http://www.bing.com")
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+	// Keys cannot be checked while the store is unavailable
+	//
+	store.err = storage.ErrUnavailable
+	response, _ = request(http.MethodPost, "/", "Bearer "+reader.Key, "http://www.bing.com")
+	assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+}
+
+func TestScoped(t *testing.T) {
+	for _, tt := range []struct {
+		scope    string
+		got      string
+		keysOnly bool
+		code     int
+	}{
+		{ScopeCreate, "", false, http.StatusOK},
+		{ScopeCreate, ScopeCreate, false, http.StatusOK},
+		{ScopeCreate, ScopeStats, false, http.StatusForbidden},
+		{ScopeCreate, ScopeAdmin, false, http.StatusOK},
+		{ScopeAdmin, "", true, http.StatusUnauthorized},
+		{ScopeAdmin, ScopeStats, true, http.StatusForbidden},
+		{ScopeAdmin, ScopeAdmin, true, http.StatusOK},
+	} {
+		h := scoped(tt.scope, tt.keysOnly)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.got != "" {
+			request = request.WithContext(context.WithValue(request.Context(), keyScope, tt.got))
+		}
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, request)
+		assert.Equal(t, tt.code, recorder.Code, "%s with %q", tt.scope, tt.got)
+	}
+}
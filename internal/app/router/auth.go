@@ -0,0 +1,94 @@
+package router
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// User identity is kept in a cookie signed with HMAC-SHA256. The cookie value is a
+// random user ID and its signature separated by a dot. A request without the cookie
+// (or with an invalid one) gets a new user ID, and the new cookie in the response.
+// Handlers get the user ID from the request context with UserID(). The requests
+// authenticated with API keys (see AuthenticateKey()) are left as they are.
+
+const cookieUserID = "user_id"
+
+type contextKey int
+
+const (
+	keyUserID contextKey = iota
+	keyNewUser
+	keyScope
+)
+
+func Authenticate(key []byte) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			// The request has been authenticated with an API key already
+			//
+			if UserID(r.Context()) != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			var id string
+			ctx := r.Context()
+			if c, err := r.Cookie(cookieUserID); err == nil {
+				id = verifyUserID(key, c.Value)
+			}
+			if id == "" {
+				b := make([]byte, 16)
+				if _, err := rand.Read(b); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				id = hex.EncodeToString(b)
+				http.SetCookie(w, &http.Cookie{
+					Name:     cookieUserID,
+					Value:    signUserID(key, id),
+					Path:     "/",
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+				ctx = context.WithValue(ctx, keyNewUser, true)
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, keyUserID, id)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// UserID() gives the user ID set by Authenticate(), or an empty string if none
+
+func UserID(ctx context.Context) string {
+	id, _ := ctx.Value(keyUserID).(string)
+	return id
+}
+
+// newUser() tells whether the user ID has just been made for the request
+
+func newUser(ctx context.Context) bool {
+	n, _ := ctx.Value(keyNewUser).(bool)
+	return n
+}
+
+func signUserID(key []byte, id string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id))
+	return id + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func verifyUserID(key []byte, value string) string {
+	id, _, ok := strings.Cut(value, ".")
+	if !ok || id == "" {
+		return ""
+	}
+	if !hmac.Equal([]byte(signUserID(key, id)), []byte(value)) {
+		return ""
+	}
+	return id
+}
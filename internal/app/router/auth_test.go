@@ -0,0 +1,245 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testKey = []byte("secret")
+
+// authenticate() sends a request through Authenticate() and gives the user ID seen by
+// the handler and the cookie set in the response (if any)
+
+func authenticate(t *testing.T, cookie *http.Cookie) (string, *http.Cookie) {
+	var id string
+	h := Authenticate(testKey)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = UserID(r.Context())
+	}))
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	response := recorder.Result()
+	defer response.Body.Close()
+	for _, c := range response.Cookies() {
+		if c.Name == cookieUserID {
+			return id, c
+		}
+	}
+	return id, nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	// A new user must get a new ID and the cookie with it
+	//
+	id, cookie := authenticate(t, nil)
+	require.NotEmpty(t, id)
+	require.NotNil(t, cookie)
+	assert.True(t, cookie.HttpOnly)
+	assert.True(t, strings.HasPrefix(cookie.Value, id+"."))
+
+	// A known user must keep the ID and must not get the cookie again
+	//
+	again, c := authenticate(t, cookie)
+	assert.Equal(t, id, again)
+	assert.Nil(t, c)
+
+	// A tampered cookie must be replaced with a new ID
+	//
+	other, c := authenticate(t, &http.Cookie{Name: cookieUserID, Value: "admin" + cookie.Value[len(id):]})
+	assert.NotEqual(t, "admin", other)
+	assert.NotEqual(t, id, other)
+	assert.NotNil(t, c)
+	other, c = authenticate(t, &http.Cookie{Name: cookieUserID, Value: "garbage"})
+	assert.NotEmpty(t, other)
+	assert.NotNil(t, c)
+
+	// No middleware means no user
+	//
+	assert.Empty(t, UserID(httptest.NewRequest(http.MethodGet, "/", nil).Context()))
+}
+
+func TestAddOwner(t *testing.T) {
+	store := urlStoreMock{i: 0, s: map[string]string{}, o: map[string]string{}}
+	router := chi.NewRouter()
+	router.Use(Authenticate(testKey))
+	New("http://server:port", router, &store)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for _, path := range []string{"/", "/api/shorten"} {
+		body := "http://www.google.com" + path
+		if path != "/" {
+			body = "{\"url\":\"" + body + "\"}"
+		}
+		response, err := http.Post(server.URL+path, "", bytes.NewReader([]byte(body)))
+		require.NoError(t, err)
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		require.Equal(t, http.StatusCreated, response.StatusCode)
+
+		// The short URL must be owned by the user from the cookie
+		//
+		var id string
+		for _, c := range response.Cookies() {
+			if c.Name == cookieUserID {
+				id = verifyUserID(testKey, c.Value)
+			}
+		}
+		require.NotEmpty(t, id)
+		assert.Equal(t, id, store.o[strconv.FormatUint(uint64(store.i), 10)])
+	}
+}
+
+func TestGetUserURLs(t *testing.T) {
+	store := urlStoreMock{i: 0, s: map[string]string{}, o: map[string]string{}}
+	router := chi.NewRouter()
+	router.Use(Authenticate(testKey))
+	New("http://server:port", router, &store)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	cookie := &http.Cookie{Name: cookieUserID, Value: signUserID(testKey, "user1")}
+	do := func(method, path, body string, cookie *http.Cookie) (int, string) {
+		response, b := send(t, method, server.URL+path, body, cookie)
+		return response.StatusCode, b
+	}
+
+	// A new user has no links yet
+	//
+	code, _ := do(http.MethodGet, "/api/user/urls", "", nil)
+	assert.Equal(t, http.StatusNoContent, code)
+
+	do(http.MethodPost, "/", "http://www.google.com", cookie)
+	do(http.MethodPost, "/", "http://www.yandex.ru", nil)
+	do(http.MethodPost, "/", "http://www.mail.ru", cookie)
+
+	code, body := do(http.MethodGet, "/api/user/urls", "", cookie)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `[{"short_url":"http://server:port/1","original_url":"http://www.google.com"},`+
+		`{"short_url":"http://server:port/3","original_url":"http://www.mail.ru"}]`+"\n", body)
+
+	code, body = do(http.MethodGet, "/api/user/urls?sort=created&order=asc&offset=1&limit=1", "", cookie)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `[{"short_url":"http://server:port/3","original_url":"http://www.mail.ru"}]`+"\n", body)
+	code, _ = do(http.MethodGet, "/api/user/urls?offset=2", "", cookie)
+	assert.Equal(t, http.StatusNoContent, code)
+
+	// Invalid list options
+	//
+	for _, query := range []string{"sort=owner", "order=up", "offset=-1", "offset=a", "limit=0", "limit=100000"} {
+		code, _ = do(http.MethodGet, "/api/user/urls?"+query, "", cookie)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
+
+func TestGetUserURLsUnauthenticated(t *testing.T) {
+	store := urlStoreMock{i: 0, s: map[string]string{}, o: map[string]string{}}
+	router := chi.NewRouter()
+	New("http://server:port", router, &store)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/api/user/urls")
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+}
+
+func TestUpdateURL(t *testing.T) {
+	store := urlStoreMock{i: 0, s: map[string]string{}, o: map[string]string{}}
+	router := chi.NewRouter()
+	router.Use(Authenticate(testKey))
+	New("http://server:port", router, &store)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	user1 := &http.Cookie{Name: cookieUserID, Value: signUserID(testKey, "user1")}
+	user2 := &http.Cookie{Name: cookieUserID, Value: signUserID(testKey, "user2")}
+	do := func(method, path, body string, cookie *http.Cookie) (int, string) {
+		response, b := send(t, method, server.URL+path, body, cookie)
+		return response.StatusCode, b
+	}
+
+	do(http.MethodPost, "/", "http://www.google.com", user1)
+	code, _ := do(http.MethodPatch, "/api/urls/1", `{"url":"http://www.yandex.ru"}`, user1)
+	assert.Equal(t, http.StatusNoContent, code)
+	assert.Equal(t, "http://www.yandex.ru", store.s["1"])
+
+	// Only the owner may change the link and see its history (requests without the
+	// cookie are of a new user)
+	//
+	for _, tt := range []struct {
+		method string
+		path   string
+		body   string
+		cookie *http.Cookie
+		code   int
+	}{
+		{http.MethodPatch, "/api/urls/1", `{"url":"http://www.mail.ru"}`, nil, http.StatusForbidden},
+		{http.MethodPatch, "/api/urls/1", `{"url":"http://www.mail.ru"}`, user2, http.StatusForbidden},
+		{http.MethodPatch, "/api/urls/2", `{"url":"http://www.mail.ru"}`, user1, http.StatusNotFound},
+		{http.MethodPatch, "/api/urls/1", `{"url":""}`, user1, http.StatusBadRequest},
+		{http.MethodPatch, "/api/urls/1", `http://www.mail.ru`, user1, http.StatusBadRequest},
+		{http.MethodGet, "/api/urls/1/history", "", nil, http.StatusForbidden},
+		{http.MethodGet, "/api/urls/1/history", "", user2, http.StatusForbidden},
+		{http.MethodGet, "/api/urls/2/history", "", user1, http.StatusNotFound},
+	} {
+		code, _ = do(tt.method, tt.path, tt.body, tt.cookie)
+		assert.Equal(t, tt.code, code, tt.method+" "+tt.path)
+	}
+
+	code, body := do(http.MethodGet, "/api/urls/1/history", "", user1)
+	assert.Equal(t, http.StatusOK, code)
+	var history struct {
+		ShortURL string `json:"short_url"`
+		History  []struct {
+			Version     int64      `json:"version"`
+			OriginalURL string     `json:"original_url"`
+			ReplacedAt  *time.Time `json:"replaced_at"`
+		} `json:"history"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &history))
+	assert.Equal(t, "http://server:port/1", history.ShortURL)
+	require.Len(t, history.History, 2)
+	assert.Equal(t, int64(1), history.History[0].Version)
+	assert.Equal(t, "http://www.google.com", history.History[0].OriginalURL)
+	assert.NotNil(t, history.History[0].ReplacedAt)
+	assert.Equal(t, int64(2), history.History[1].Version)
+	assert.Equal(t, "http://www.yandex.ru", history.History[1].OriginalURL)
+	assert.Nil(t, history.History[1].ReplacedAt)
+}
+
+func TestUpdateURLUnauthenticated(t *testing.T) {
+	store := urlStoreMock{i: 0, s: map[string]string{"1": "http://www.google.com"}, o: map[string]string{"1": "user1"}}
+	router := chi.NewRouter()
+	New("http://server:port", router, &store)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for _, tt := range []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodPatch, "/api/urls/1", `{"url":"http://www.mail.ru"}`},
+		{http.MethodGet, "/api/urls/1/history", ""},
+		{http.MethodGet, "/api/stats/1", ""},
+	} {
+		response, _ := send(t, tt.method, server.URL+tt.path, tt.body, nil)
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode, tt.method+" "+tt.path)
+	}
+}
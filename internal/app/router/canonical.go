@@ -0,0 +1,108 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/nickeroshenkov/urlShortener/internal/app/hostname"
+)
+
+// Full URLs are checked and brought to the canonical form before they are stored, so
+// that equivalent URLs get the same short URL. Only absolute http and https URLs with
+// a host are taken. The canonical form has:
+// - the scheme and the host in lower case, and the host in punycode (see hostname)
+// - no root dot at the end of the host (example.com. is example.com)
+// - no default port (80 for http, 443 for https)
+// - no root path alone (http://host/ is http://host)
+// - no empty query or fragment (a trailing '?' or '#')
+// The rest (the path, the query and the fragment) is kept as is, as servers may treat
+// them in their own way. Surrounding whitespace is trimmed, but the URL must not have
+// any inside.
+
+const maxURLLength = 8192
+
+var allowedSchemes = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+func canonicalURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", errors.New("URL is empty")
+	}
+	if len(raw) > maxURLLength {
+		return "", fmt.Errorf("URL is longer than %d bytes", maxURLLength)
+	}
+	for _, c := range raw {
+		if c <= ' ' || c == 0x7f {
+			return "", fmt.Errorf("URL must not contain %q", c)
+		}
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("URL is malformed: %w", errors.Unwrap(err))
+	}
+	if u.Scheme == "" {
+		return "", errors.New("URL must be absolute, e.g. https://example.com")
+	}
+	defaultPort, ok := allowedSchemes[u.Scheme]
+	if !ok {
+		return "", fmt.Errorf("URL scheme %q is not allowed, only http and https are", u.Scheme)
+	}
+	if u.Opaque != "" || u.Hostname() == "" {
+		return "", errors.New("URL has no host")
+	}
+
+	host, err := canonicalHost(u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", fmt.Errorf("URL port %q is out of range", port)
+		}
+	}
+	if port == defaultPort {
+		port = ""
+	}
+	switch {
+	case port != "":
+		u.Host = net.JoinHostPort(host, port)
+	case strings.Contains(host, ":"):
+		u.Host = "[" + host + "]"
+	default:
+		u.Host = host
+	}
+	if u.Path == "/" && u.RawPath == "" {
+		u.Path = ""
+	}
+	u.ForceQuery = false
+	return u.String(), nil
+}
+
+// canonicalHost() keeps IP addresses as they are (in lower case), and converts domain
+// names to punycode without the root dot
+
+func canonicalHost(host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return strings.ToLower(host), nil
+	}
+	host = strings.TrimSuffix(host, ".")
+	if host == "" {
+		return "", errors.New("URL has no host")
+	}
+	if strings.HasPrefix(host, ".") || strings.HasSuffix(host, ".") || strings.Contains(host, "..") {
+		return "", fmt.Errorf("URL host %q is invalid: empty label", host)
+	}
+	ascii, err := hostname.ToASCII(host)
+	if err != nil {
+		return "", fmt.Errorf("URL host %q is invalid: %w", host, err)
+	}
+	return ascii, nil
+}
@@ -0,0 +1,147 @@
+package router
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nickeroshenkov/urlShortener/internal/app/storage"
+)
+
+// Clicks are recorded asynchronously, so that redirects are not slowed by the store.
+// Redirects put the clicks into the bounded queue without waiting, and the clicks are
+// dropped if the queue is full. The recorder passes them to the store in batches once
+// there are enough of them or the flush interval has passed. Redirects served after
+// the recorder is closed are not recorded.
+//
+// IP addresses (as set by middleware.RealIP) are hashed with a random key made on start,
+// so the same address gives the same hash while the server runs, and the addresses
+// cannot be recovered from the hashes.
+
+const (
+	clickQueueSize = 4096
+	clickBatchSize = 500
+	clickInterval  = time.Second
+	clickTimeout   = 30 * time.Second
+)
+
+type recorder struct {
+	storer  storage.URLStorer
+	queue   chan storage.Click
+	key     []byte
+	dropped atomic.Int64
+	mu      sync.RWMutex // guards the queue from being closed while clicks are queued
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func newRecorder(s storage.URLStorer) *recorder {
+	rec := &recorder{
+		storer: s,
+		queue:  make(chan storage.Click, clickQueueSize),
+		key:    make([]byte, 32),
+	}
+	if _, err := rand.Read(rec.key); err != nil {
+		panic(err)
+	}
+	rec.wg.Add(1)
+	go rec.run()
+	return rec
+}
+
+// click() makes the click of the redirect request and queues it if there is room
+
+func (rec *recorder) click(r *http.Request, short string) {
+	c := storage.Click{
+		Short:     short,
+		Time:      time.Now(),
+		Referrer:  referrerHost(r.Referer()),
+		UserAgent: r.UserAgent(),
+		IPHash:    rec.hashIP(r.RemoteAddr),
+	}
+	rec.mu.RLock()
+	defer rec.mu.RUnlock()
+	if rec.closed {
+		return
+	}
+	select {
+	case rec.queue <- c:
+	default:
+		rec.dropped.Add(1)
+	}
+}
+
+// referrerHost() keeps only the host of the referring page, as the full URLs would
+// make too many distinct referrers (and may carry private data)
+
+func referrerHost(referrer string) string {
+	u, err := url.Parse(referrer)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+func (rec *recorder) hashIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	mac := hmac.New(sha256.New, rec.key)
+	mac.Write([]byte(addr))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (rec *recorder) run() {
+	defer rec.wg.Done()
+	ticker := time.NewTicker(clickInterval)
+	defer ticker.Stop()
+	var pending []storage.Click
+	flush := func() {
+		if n := rec.dropped.Swap(0); n > 0 {
+			log.Printf("%d clicks dropped as the queue is full", n)
+		}
+		if len(pending) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), clickTimeout)
+		if err := rec.storer.AddClicks(ctx, pending); err != nil {
+			log.Println(err)
+		}
+		cancel()
+		pending = nil
+	}
+	for {
+		select {
+		case c, ok := <-rec.queue:
+			if !ok {
+				flush()
+				return
+			}
+			pending = append(pending, c)
+			if len(pending) >= clickBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Close() records everything queued and stops the recorder
+
+func (rec *recorder) Close() {
+	rec.mu.Lock()
+	rec.closed = true
+	close(rec.queue)
+	rec.mu.Unlock()
+	rec.wg.Wait()
+}
@@ -0,0 +1,96 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nickeroshenkov/urlShortener/internal/app/storage"
+)
+
+func TestStats(t *testing.T) {
+	store := urlStoreMock{i: 0, s: map[string]string{"1": "http://www.google.com"}, o: map[string]string{"1": "user1"}}
+	router := chi.NewRouter()
+	router.Use(Authenticate(testKey))
+	rou := New("http://server:port", router, &store)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	user1 := &http.Cookie{Name: cookieUserID, Value: signUserID(testKey, "user1")}
+	user2 := &http.Cookie{Name: cookieUserID, Value: signUserID(testKey, "user2")}
+	get := func(path, referrer string, cookie *http.Cookie) (*http.Response, string) {
+		return send(t, http.MethodGet, server.URL+path, "", cookie, "User-Agent", "test", "Referer", referrer)
+	}
+	for _, referrer := range []string{"https://yandex.ru/search?text=1", "https://yandex.ru/", "", "http://mail.ru"} {
+		response, _ := get("/1", referrer, nil)
+		require.Equal(t, http.StatusTemporaryRedirect, response.StatusCode)
+	}
+	response, _ := get("/2", "", nil)
+	require.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	// Closing the router records the queued clicks, and only the successful redirects
+	// are recorded
+	//
+	require.NoError(t, rou.Close())
+	require.Len(t, store.c, 4)
+	for _, c := range store.c {
+		assert.Equal(t, "1", c.Short)
+		assert.Equal(t, "test", c.UserAgent)
+		assert.Equal(t, store.c[0].IPHash, c.IPHash)
+		assert.NotContains(t, c.IPHash, "127.0.0.1")
+	}
+	assert.Len(t, store.c[0].IPHash, 64)
+
+	// Only the owner may see the statistics (requests without the cookie are of a new
+	// user)
+	//
+	for _, cookie := range []*http.Cookie{nil, user2} {
+		response, _ = get("/api/stats/1", "", cookie)
+		assert.Equal(t, http.StatusForbidden, response.StatusCode)
+	}
+
+	response, body := get("/api/stats/1", "", user1)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	var stats struct {
+		ShortURL string `json:"short_url"`
+		Total    int64  `json:"total"`
+		Days     []struct {
+			Date   string `json:"date"`
+			Clicks int64  `json:"clicks"`
+		} `json:"days"`
+		Referrers []struct {
+			Referrer string `json:"referrer"`
+			Clicks   int64  `json:"clicks"`
+		} `json:"referrers"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &stats))
+	assert.Equal(t, "http://server:port/1", stats.ShortURL)
+	assert.Equal(t, int64(4), stats.Total)
+	require.Len(t, stats.Days, 1)
+	assert.Equal(t, time.Now().UTC().Format("2006-01-02"), stats.Days[0].Date)
+	require.Len(t, stats.Referrers, 3)
+	assert.Equal(t, "yandex.ru", stats.Referrers[0].Referrer)
+	assert.Equal(t, int64(2), stats.Referrers[0].Clicks)
+	assert.Equal(t, "", stats.Referrers[1].Referrer)
+	assert.Equal(t, "mail.ru", stats.Referrers[2].Referrer)
+
+	response, _ = get("/api/stats/2", "", user1)
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+func TestRecorderDrops(t *testing.T) {
+	// The recorder is not running here, so the queue of one click fills up at once
+	//
+	rec := &recorder{queue: make(chan storage.Click, 1)}
+	request := httptest.NewRequest(http.MethodGet, "/1", nil)
+	rec.click(request, "1")
+	rec.click(request, "1")
+	assert.Len(t, rec.queue, 1)
+	assert.Equal(t, int64(1), rec.dropped.Load())
+}
@@ -0,0 +1,109 @@
+package router
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nickeroshenkov/urlShortener/internal/app/storage"
+)
+
+// Deletion of short URLs is asynchronous. Handlers put the deletion requests into the
+// queue and reply at once. The batcher merges the requests of the same user and passes
+// them to the workers once there are enough short URLs or the flush interval has
+// passed, so that the store gets few large batches instead of many small ones.
+
+const (
+	deleteQueueSize = 1024
+	deleteBatchSize = 100
+	deleteInterval  = time.Second
+	deleteWorkers   = 4
+	deleteTimeout   = 30 * time.Second
+)
+
+type deleteRequest struct {
+	owner  string
+	shorts []string
+}
+
+type deleter struct {
+	storer  storage.URLStorer
+	queue   chan deleteRequest
+	batches chan deleteRequest
+	wg      sync.WaitGroup
+}
+
+func newDeleter(s storage.URLStorer) *deleter {
+	d := &deleter{
+		storer:  s,
+		queue:   make(chan deleteRequest, deleteQueueSize),
+		batches: make(chan deleteRequest),
+	}
+	d.wg.Add(1 + deleteWorkers)
+	go d.batcher()
+	for i := 0; i < deleteWorkers; i++ {
+		go d.worker()
+	}
+	return d
+}
+
+// enqueue() waits for a free place in the queue as long as the request context allows
+
+func (d *deleter) enqueue(ctx context.Context, req deleteRequest) error {
+	select {
+	case d.queue <- req:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *deleter) batcher() {
+	defer d.wg.Done()
+	defer close(d.batches)
+	ticker := time.NewTicker(deleteInterval)
+	defer ticker.Stop()
+	pending, n := map[string][]string{}, 0
+	flush := func() {
+		for owner, shorts := range pending {
+			d.batches <- deleteRequest{owner: owner, shorts: shorts}
+		}
+		pending, n = map[string][]string{}, 0
+	}
+	for {
+		select {
+		case req, ok := <-d.queue:
+			if !ok {
+				flush()
+				return
+			}
+			pending[req.owner] = append(pending[req.owner], req.shorts...)
+			n += len(req.shorts)
+			if n >= deleteBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (d *deleter) worker() {
+	defer d.wg.Done()
+	for req := range d.batches {
+		ctx, cancel := context.WithTimeout(context.Background(), deleteTimeout)
+		if err := d.storer.DeleteBatch(ctx, req.shorts, req.owner); err != nil {
+			log.Println(err)
+		}
+		cancel()
+	}
+}
+
+// Close() deletes everything queued and stops the deleter. It must be called after the
+// handlers are done, as nothing may be queued after that.
+
+func (d *deleter) Close() {
+	close(d.queue)
+	d.wg.Wait()
+}
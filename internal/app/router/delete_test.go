@@ -0,0 +1,96 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteUserURLs(t *testing.T) {
+	store := urlStoreMock{i: 0, s: map[string]string{}, o: map[string]string{}}
+	router := chi.NewRouter()
+	router.Use(Authenticate(testKey))
+	rou := New("http://server:port", router, &store)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	user1 := &http.Cookie{Name: cookieUserID, Value: signUserID(testKey, "user1")}
+	user2 := &http.Cookie{Name: cookieUserID, Value: signUserID(testKey, "user2")}
+	do := func(method, path, body string, cookie *http.Cookie) int {
+		response, _ := send(t, method, server.URL+path, body, cookie)
+		return response.StatusCode
+	}
+
+	do(http.MethodPost, "/", "http://www.google.com", user1)
+	do(http.MethodPost, "/", "http://www.yandex.ru", user1)
+	do(http.MethodPost, "/", "http://www.mail.ru", user2)
+
+	// Deletion is accepted at once, and the links of other users are skipped
+	//
+	assert.Equal(t, http.StatusAccepted, do(http.MethodDelete, "/api/user/urls", `["1","3","100"]`, user1))
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodDelete, "/api/user/urls", `[]`, user1))
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodDelete, "/api/user/urls", `"1"`, user1))
+
+	// Closing the router finishes the queued deletions
+	//
+	require.NoError(t, rou.Close())
+	assert.Equal(t, http.StatusGone, do(http.MethodGet, "/1", "", user1))
+	assert.Equal(t, http.StatusTemporaryRedirect, do(http.MethodGet, "/2", "", user1))
+	assert.Equal(t, http.StatusTemporaryRedirect, do(http.MethodGet, "/3", "", user1))
+}
+
+func TestDeleteUserURLsUnauthenticated(t *testing.T) {
+	store := urlStoreMock{i: 0, s: map[string]string{}, o: map[string]string{}}
+	router := chi.NewRouter()
+	New("http://server:port", router, &store)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	response, _ := send(t, http.MethodDelete, server.URL+"/api/user/urls", `["1"]`, nil)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+}
+
+// deleteBatchMock records the batches deleted
+
+type deleteBatchMock struct {
+	urlStoreMock
+	mu      sync.Mutex
+	batches map[string][][]string
+}
+
+func (store *deleteBatchMock) DeleteBatch(ctx context.Context, shorts []string, owner string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.batches[owner] = append(store.batches[owner], shorts)
+	return nil
+}
+
+func TestDeleterBatches(t *testing.T) {
+	store := deleteBatchMock{batches: map[string][][]string{}}
+	d := newDeleter(&store)
+
+	// Requests of the same user are merged, and a batch is flushed once it is large
+	// enough, so there is one batch for each user here
+	//
+	ctx := context.Background()
+	var want []string
+	for i := 0; i < deleteBatchSize-1; i++ {
+		short := strings.Repeat("a", i+1)
+		require.NoError(t, d.enqueue(ctx, deleteRequest{owner: "user1", shorts: []string{short}}))
+		want = append(want, short)
+	}
+	require.NoError(t, d.enqueue(ctx, deleteRequest{owner: "user2", shorts: []string{"b", "c"}}))
+	d.Close()
+
+	require.Len(t, store.batches["user1"], 1)
+	assert.Equal(t, want, store.batches["user1"][0])
+	require.Len(t, store.batches["user2"], 1)
+	assert.Equal(t, []string{"b", "c"}, store.batches["user2"][0])
+}
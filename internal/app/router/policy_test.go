@@ -0,0 +1,55 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// policyMock denies the full URLs containing any of the words
+
+type policyMock []string
+
+func (p policyMock) Check(url string) error {
+	for _, word := range p {
+		if strings.Contains(url, word) {
+			return errors.New("URL is denied by the policy")
+		}
+	}
+	return nil
+}
+
+func TestPolicy(t *testing.T) {
+	store := urlStoreMock{i: 1, s: map[string]string{"1": "http://www.evil.com"}, n: map[string]int{}}
+	router := chi.NewRouter()
+	rou := New("http://localhost:8080", router, &store)
+	rou.SetPolicy(policyMock{"evil"})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	request := func(method, path, contentType, body string) int {
+		response, _ := send(t, method, server.URL+path, body, nil, "Content-Type", contentType)
+		return response.StatusCode
+	}
+
+	// Denied full URLs are not shortened
+	//
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/", "text/plain", "http://www.evil.com/page"))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/api/shorten", "application/json", `{"url":"http://evil.org"}`))
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/api/shorten/batch", "application/json",
+		`[{"correlation_id":"a","original_url":"http://www.google.com"},{"correlation_id":"b","original_url":"http://evil.org"}]`))
+	assert.Equal(t, http.StatusCreated, request(http.MethodPost, "/", "text/plain", "http://www.google.com"))
+	assert.Len(t, store.s, 2)
+
+	// Nor followed, if they were shortened before they were denied, and such redirects
+	// are not counted
+	//
+	assert.Equal(t, http.StatusForbidden, request(http.MethodGet, "/1", "", ""))
+	assert.Equal(t, http.StatusTemporaryRedirect, request(http.MethodGet, "/2", "", ""))
+	assert.Equal(t, map[string]int{"2": 1}, store.n)
+}
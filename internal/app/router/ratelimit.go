@@ -0,0 +1,156 @@
+package router
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Requests are rate limited with token buckets, one bucket per client for each kind of
+// traffic, so that a client flooding the service with new links does not slow down
+// the redirects and vice versa. A bucket holds up to the burst of tokens and is refilled
+// at the rate, each request takes a token (a batch takes one for each URL in it), and
+// the request is rejected with 429 and the Retry-After header if there are not enough
+// of them. A batch larger than the burst could never pass, so it is rejected with 413.
+//
+// Clients are told apart by their IP addresses (as set by middleware.RealIP), or by the
+// user IDs if the request comes with a valid cookie and the limits are set so. Users
+// are free to make, so keying by them only suits the services where clients behind
+// the same address (e.g. a NAT) must not share the limit. The requests without a valid
+// cookie are always keyed by the IP addresses.
+
+const bucketSweepEvery = time.Minute
+
+type RateLimit struct {
+	Rate  float64 // tokens per second, zero means no limit
+	Burst int     // at least one
+}
+
+type RateLimits struct {
+	Create   RateLimit // adding links
+	Redirect RateLimit // following short URLs
+	ByUser   bool
+}
+
+type limitKind int
+
+const (
+	limitCreate limitKind = iota
+	limitRedirect
+)
+
+// limiter keeps the buckets of the clients for one kind of traffic. The buckets which
+// have been refilled (so are no different from the new ones) are dropped now and then.
+
+type limiter struct {
+	limit   RateLimit
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(limit RateLimit) *limiter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &limiter{limit: limit, buckets: map[string]*bucket{}, swept: time.Now()}
+}
+
+// take() takes the tokens from the bucket of the client, or tells how long to wait for
+// them. There must be no more of them than the burst.
+
+func (l *limiter) take(key string, n int, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) >= bucketSweepEvery {
+		for k, b := range l.buckets {
+			if l.refill(b, now) >= float64(l.limit.Burst) {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens, b.last = l.refill(b, now), now
+	if b.tokens < float64(n) {
+		return time.Duration((float64(n) - b.tokens) / l.limit.Rate * float64(time.Second)), false
+	}
+	b.tokens -= float64(n)
+	return 0, true
+}
+
+func (l *limiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.limit.Rate
+	return math.Min(tokens, float64(l.limit.Burst))
+}
+
+// SetRateLimits() sets the limits, it must be called before the router serves requests.
+// There are no limits by default.
+
+func (rou *URLRouter) SetRateLimits(limits RateLimits) {
+	rou.limiters = map[limitKind]*limiter{
+		limitCreate:   newLimiter(limits.Create),
+		limitRedirect: newLimiter(limits.Redirect),
+	}
+	rou.limitByUser = limits.ByUser
+}
+
+// rateLimit() gives the middleware limiting the kind of traffic
+
+func (rou *URLRouter) rateLimit(kind limitKind) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if rou.allow(w, r, kind, 1) {
+				next.ServeHTTP(w, r)
+			}
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// allow() takes the tokens for the request, or replies with the error if it is limited
+
+func (rou URLRouter) allow(w http.ResponseWriter, r *http.Request, kind limitKind, n int) bool {
+	l := rou.limiters[kind]
+	if l == nil {
+		return true
+	}
+	if n > l.limit.Burst {
+		http.Error(w, fmt.Sprintf("Too many URLs at once, at most %d are allowed", l.limit.Burst), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	wait, ok := l.take(rou.clientKey(r), n, time.Now())
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+func (rou URLRouter) clientKey(r *http.Request) string {
+	if id := UserID(r.Context()); rou.limitByUser && id != "" && !newUser(r.Context()) {
+		return "user:" + id
+	}
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return "ip:" + addr
+}
@@ -0,0 +1,127 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	assert.Nil(t, newLimiter(RateLimit{}))
+
+	l := newLimiter(RateLimit{Rate: 2, Burst: 3})
+	now := time.Now()
+
+	// The burst is taken at once, and then the tokens come at the rate
+	//
+	for i := 0; i < 3; i++ {
+		_, ok := l.take("a", 1, now)
+		require.True(t, ok, i)
+	}
+	wait, ok := l.take("a", 1, now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	wait, ok = l.take("a", 1, now.Add(200*time.Millisecond))
+	assert.False(t, ok)
+	assert.Equal(t, 300*time.Millisecond, wait)
+	_, ok = l.take("a", 1, now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+
+	// Other clients have their own buckets
+	//
+	_, ok = l.take("b", 1, now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+
+	// Several tokens are taken at once or none
+	//
+	wait, ok = l.take("b", 3, now.Add(500*time.Millisecond))
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	_, ok = l.take("b", 2, now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+
+	// Refilled buckets are dropped
+	//
+	later := now.Add(bucketSweepEvery + time.Second)
+	_, ok = l.take("a", 1, later)
+	assert.True(t, ok)
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestRateLimit(t *testing.T) {
+	store := urlStoreMock{i: 0, s: map[string]string{}}
+	router := chi.NewRouter()
+	router.Use(Authenticate([]byte("secret")))
+	rou := New("http://localhost:8080", router, &store)
+	rou.SetRateLimits(RateLimits{
+		Create:   RateLimit{Rate: 0.001, Burst: 2},
+		Redirect: RateLimit{Rate: 0.001, Burst: 3},
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	request := func(method, path string, cookie *http.Cookie) *http.Response {
+		response, _ := send(t, method, server.URL+path, "http://www.google.com", cookie)
+		return response
+	}
+
+	// Creating is limited apart from redirects
+	//
+	response := request(http.MethodPost, "/", nil)
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+	assert.Equal(t, http.StatusConflict, request(http.MethodPost, "/", nil).StatusCode)
+	response = request(http.MethodPost, "/api/shorten", nil)
+	assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+	assert.Equal(t, "1000", response.Header.Get("Retry-After"))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusTemporaryRedirect, request(http.MethodGet, "/1", nil).StatusCode, i)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, request(http.MethodGet, "/1", nil).StatusCode)
+
+	// Batches take a token for each URL, and the ones larger than the burst never pass
+	//
+	rou.SetRateLimits(RateLimits{Create: RateLimit{Rate: 0.001, Burst: 3}})
+	batch := func(n int) *http.Response {
+		items := make([]string, n)
+		for i := range items {
+			items[i] = fmt.Sprintf(`{"correlation_id":"%d","original_url":"http://www.google.com/%d"}`, i, i)
+		}
+		response, _ := send(t, http.MethodPost, server.URL+"/api/shorten/batch", "["+strings.Join(items, ",")+"]", nil)
+		return response
+	}
+	assert.Equal(t, http.StatusRequestEntityTooLarge, batch(4).StatusCode)
+	assert.Equal(t, http.StatusCreated, batch(2).StatusCode)
+	response = batch(2)
+	assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+	assert.Equal(t, "1000", response.Header.Get("Retry-After"))
+	assert.Equal(t, http.StatusConflict, request(http.MethodPost, "/", nil).StatusCode)
+	assert.Equal(t, http.StatusTooManyRequests, request(http.MethodPost, "/", nil).StatusCode)
+	rou.SetRateLimits(RateLimits{})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, batch(maxBatchSize+1).StatusCode)
+
+	// The other routes are not limited
+	//
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/healthz", nil).StatusCode)
+
+	// Keying by users gives each user with a valid cookie a bucket of their own, and
+	// the requests without one stay keyed by the address
+	//
+	rou.SetRateLimits(RateLimits{Create: RateLimit{Rate: 0.001, Burst: 1}, ByUser: true})
+	response = request(http.MethodPost, "/", nil)
+	require.Equal(t, http.StatusConflict, response.StatusCode)
+	cookie := response.Cookies()[0]
+	assert.Equal(t, http.StatusTooManyRequests, request(http.MethodPost, "/", nil).StatusCode)
+	assert.Equal(t, http.StatusConflict, request(http.MethodPost, "/", cookie).StatusCode)
+	assert.Equal(t, http.StatusTooManyRequests, request(http.MethodPost, "/", cookie).StatusCode)
+
+	// Zero rate means no limit
+	//
+	assert.Equal(t, http.StatusTemporaryRedirect, request(http.MethodGet, "/1", nil).StatusCode)
+}
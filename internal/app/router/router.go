@@ -1,10 +1,17 @@
 package router
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 
@@ -16,54 +23,196 @@ const (
 	headerContentType = "Content-Type"
 )
 
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+const pingTimeout = 2 * time.Second
+
+// Batches of more URLs are rejected whatever the rate limits are
+
+const maxBatchSize = 1000
+
 type URLRouter struct {
-	baseURL   string
-	router chi.Router
-	storer storage.URLStorer
+	baseURL     string
+	router      chi.Router
+	storer      storage.URLStorer
+	deleter     *deleter
+	recorder    *recorder
+	ready       *atomic.Bool
+	reserved    map[string]bool
+	selfHosts   map[string]bool
+	basePath    string
+	policy      Policy
+	limiters    map[limitKind]*limiter
+	limitByUser bool
 }
 
-func New(s string, c chi.Router, u storage.URLStorer) *URLRouter {
+// Policy tells whether the full URL may be shortened and followed, it returns the reason
+// if not
+
+type Policy interface {
+	Check(url string) error
+}
+
+// New() sets the routes up. The base URL host and the alias hosts are the hosts of the
+// service, which full URLs must not point at (see resolveURL()).
+
+func New(s string, c chi.Router, u storage.URLStorer, aliasHosts ...string) *URLRouter {
 	rou := URLRouter{
-		baseURL:   s,
-		router: c,
-		storer: u,
+		baseURL:  s,
+		router:   c,
+		storer:   u,
+		deleter:  newDeleter(u),
+		recorder: newRecorder(u),
+		ready:    &atomic.Bool{},
 	}
-	rou.router.Post("/", func(w http.ResponseWriter, r *http.Request) {
+	rou.ready.Store(true)
+	rou.selfHosts, rou.basePath = selfHosts(s, aliasHosts)
+	create := rou.router.With(scoped(ScopeCreate, false), rou.rateLimit(limitCreate))
+	create.Post("/", func(w http.ResponseWriter, r *http.Request) {
 		rou.addURL(w, r)
 	})
-	rou.router.Post("/api/shorten", func(w http.ResponseWriter, r *http.Request) {
+	create.Post("/api/shorten", func(w http.ResponseWriter, r *http.Request) {
 		rou.addURLAPI(w, r)
 	})
-	rou.router.Get("/{short}", func(w http.ResponseWriter, r *http.Request) {
+	// Batches take the tokens for their URLs in the handler
+	//
+	rou.router.With(scoped(ScopeCreate, false)).Post("/api/shorten/batch", func(w http.ResponseWriter, r *http.Request) {
+		rou.addURLBatch(w, r)
+	})
+	stats := rou.router.With(scoped(ScopeStats, false))
+	stats.Get("/api/user/urls", func(w http.ResponseWriter, r *http.Request) {
+		rou.getUserURLs(w, r)
+	})
+	stats.Get("/api/urls/{short}/history", func(w http.ResponseWriter, r *http.Request) {
+		rou.getHistory(w, r)
+	})
+	stats.Get("/api/stats/{short}", func(w http.ResponseWriter, r *http.Request) {
+		rou.getStats(w, r)
+	})
+	admin := rou.router.With(scoped(ScopeAdmin, false))
+	admin.Delete("/api/user/urls", func(w http.ResponseWriter, r *http.Request) {
+		rou.deleteUserURLs(w, r)
+	})
+	admin.Patch("/api/urls/{short}", func(w http.ResponseWriter, r *http.Request) {
+		rou.updateURL(w, r)
+	})
+	keys := rou.router.With(scoped(ScopeAdmin, true))
+	keys.Post("/api/admin/keys", func(w http.ResponseWriter, r *http.Request) {
+		rou.addKey(w, r)
+	})
+	keys.Get("/api/admin/keys", func(w http.ResponseWriter, r *http.Request) {
+		rou.getKeys(w, r)
+	})
+	keys.Delete("/api/admin/keys/{id}", func(w http.ResponseWriter, r *http.Request) {
+		rou.revokeKey(w, r)
+	})
+	rou.router.Get("/ping", func(w http.ResponseWriter, r *http.Request) {
+		rou.ping(w, r)
+	})
+	rou.router.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	rou.router.Get("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		rou.readyz(w, r)
+	})
+	rou.router.With(rou.rateLimit(limitRedirect)).Get("/{short}", func(w http.ResponseWriter, r *http.Request) {
 		rou.getURL(w, r)
 	})
+	rou.reserved = reservedAliases(rou.router)
+	if r, ok := u.(storage.Reserver); ok {
+		r.Reserve(rou.reserved)
+	}
 
 	return &rou
 }
 
+// SetReady() sets whether the server is ready to serve requests, it is not ready once
+// the shutdown has started
+
+func (rou *URLRouter) SetReady(ready bool) {
+	rou.ready.Store(ready)
+}
+
+// SetPolicy() sets the policy for the full URLs, it must be called before the router
+// serves requests. There is no policy by default.
+
+func (rou *URLRouter) SetPolicy(p Policy) {
+	rou.policy = p
+}
+
+// Close() finishes the queued deletions and clicks before closing the store
+
 func (rou *URLRouter) Close() error {
+	rou.deleter.Close()
+	rou.recorder.Close()
 	return rou.storer.Close()
 }
 
+// storageError() replies to the request with the status matching the storage error.
+// Nothing is replied if the client has gone already.
+
+func storageError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, storage.ErrDeleted), errors.Is(err, storage.ErrExpired):
+		http.Error(w, err.Error(), http.StatusGone)
+	case errors.Is(err, storage.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, storage.ErrConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, storage.ErrUnavailable), errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// addStatus() gives the status for a new short URL, or for the existing one if the
+// full URL has been already added (the existing short URL is still replied then)
+
+func addStatus(created bool) int {
+	if created {
+		return http.StatusCreated
+	}
+	return http.StatusConflict
+}
+
 func (rou URLRouter) addURL(w http.ResponseWriter, r *http.Request) {
-	url, err1 := io.ReadAll(r.Body)
+	body, err1 := io.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err1 != nil {
 		http.Error(w, err1.Error(), http.StatusInternalServerError)
 		return
 	}
-	short, err2 := rou.storer.Add(string(url))
+	url, err1 := rou.targetURL(r.Context(), string(body))
+	if err1 != nil {
+		targetError(w, err1)
+		return
+	}
+	short, created, err2 := rou.storer.Add(r.Context(), url, UserID(r.Context()))
 	if err2 != nil {
-		http.Error(w, err2.Error(), http.StatusInternalServerError)
+		storageError(w, err2)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(addStatus(created))
 	fmt.Fprint(w, rou.baseURL+"/"+short)
 }
 
+// addURLAPI() makes the short URL, or takes the alias if it is given. The link may
+// expire at the time (in RFC 3339 format) or after the number of redirects.
+
 func (rou URLRouter) addURLAPI(w http.ResponseWriter, r *http.Request) {
 	var request struct {
-		URL string `json:"url"`
+		URL       string    `json:"url"`
+		Alias     string    `json:"alias,omitempty"`
+		ExpiresAt time.Time `json:"expires_at,omitempty"`
+		MaxClicks int64     `json:"max_clicks,omitempty"`
 	}
 	var response struct {
 		Result string `json:"result"`
@@ -73,13 +222,91 @@ func (rou URLRouter) addURLAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
-	short, err := rou.storer.Add(string(request.URL))
+	url, err := rou.targetURL(r.Context(), request.URL)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		targetError(w, err)
+		return
+	}
+	if request.Alias != "" {
+		if err := rou.validAlias(request.Alias); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !request.ExpiresAt.IsZero() && !request.ExpiresAt.After(time.Now()) {
+		http.Error(w, "Expiration time must be in the future", http.StatusBadRequest)
+		return
+	}
+	if request.MaxClicks < 0 {
+		http.Error(w, "Max clicks must not be negative", http.StatusBadRequest)
+		return
+	}
+	opts := storage.AddOptions{
+		Alias:     request.Alias,
+		ExpiresAt: request.ExpiresAt,
+		MaxClicks: request.MaxClicks,
+	}
+	short, created, err := rou.storer.AddWithOptions(r.Context(), url, UserID(r.Context()), opts)
+	if err != nil {
+		storageError(w, err)
 		return
 	}
 	response.Result = fmt.Sprintf("%s/%s", rou.baseURL, short)
 	w.Header().Set(headerContentType, "application/json")
+	w.WriteHeader(addStatus(created))
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (rou URLRouter) addURLBatch(w http.ResponseWriter, r *http.Request) {
+	var request []struct {
+		CorrelationID string `json:"correlation_id"`
+		OriginalURL   string `json:"original_url"`
+	}
+	type item struct {
+		CorrelationID string `json:"correlation_id"`
+		ShortURL      string `json:"short_url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if len(request) == 0 {
+		http.Error(w, "Batch is empty", http.StatusBadRequest)
+		return
+	}
+	if len(request) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("Batch is too large, at most %d URLs are allowed", maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !rou.allow(w, r, limitCreate, len(request)) {
+		return
+	}
+	urls := make([]string, len(request))
+	for i, v := range request {
+		url, err := rou.targetURL(r.Context(), v.OriginalURL)
+		if err != nil {
+			targetError(w, fmt.Errorf("%w (correlation_id %q)", err, v.CorrelationID))
+			return
+		}
+		urls[i] = url
+	}
+	shorts, err := rou.storer.AddBatch(r.Context(), urls, UserID(r.Context()))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	response := make([]item, len(request))
+	for i, v := range request {
+		response[i] = item{
+			CorrelationID: v.CorrelationID,
+			ShortURL:      fmt.Sprintf("%s/%s", rou.baseURL, shorts[i]),
+		}
+	}
+	w.Header().Set(headerContentType, "application/json")
 	w.WriteHeader(http.StatusCreated)
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -87,17 +314,295 @@ func (rou URLRouter) addURLAPI(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// listOptions() parses the query parameters of the list: sort (created, short_url or
+// original_url), order (asc or desc), offset and limit
+
+func listOptions(query url.Values) (storage.ListOptions, error) {
+	opts := storage.ListOptions{
+		SortBy: storage.SortCreated,
+		Limit:  defaultPageLimit,
+	}
+	if v := query.Get("sort"); v != "" {
+		switch v {
+		case storage.SortCreated, storage.SortShort, storage.SortURL:
+			opts.SortBy = v
+		default:
+			return opts, fmt.Errorf("unknown sort %q", v)
+		}
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, fmt.Errorf("unknown order %q", query.Get("order"))
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid offset %q", v)
+		}
+		opts.Offset = n
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxPageLimit {
+			return opts, fmt.Errorf("invalid limit %q, it must be from 1 to %d", v, maxPageLimit)
+		}
+		opts.Limit = n
+	}
+	return opts, nil
+}
+
+func (rou URLRouter) getUserURLs(w http.ResponseWriter, r *http.Request) {
+	type item struct {
+		ShortURL    string `json:"short_url"`
+		OriginalURL string `json:"original_url"`
+	}
+	owner := UserID(r.Context())
+	if owner == "" {
+		http.Error(w, "User is not authenticated", http.StatusUnauthorized)
+		return
+	}
+	opts, err := listOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	links, err := rou.storer.ListByOwner(r.Context(), owner, opts)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if len(links) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	response := make([]item, len(links))
+	for i, link := range links {
+		response[i] = item{
+			ShortURL:    fmt.Sprintf("%s/%s", rou.baseURL, link.Short),
+			OriginalURL: link.URL,
+		}
+	}
+	w.Header().Set(headerContentType, "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// deleteUserURLs() only queues the short URLs for deletion, so the reply does not tell
+// whether they are the user's ones (the others are skipped silently)
+
+func (rou URLRouter) deleteUserURLs(w http.ResponseWriter, r *http.Request) {
+	owner := UserID(r.Context())
+	if owner == "" {
+		http.Error(w, "User is not authenticated", http.StatusUnauthorized)
+		return
+	}
+	var shorts []string
+	if err := json.NewDecoder(r.Body).Decode(&shorts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if len(shorts) == 0 {
+		http.Error(w, "List is empty", http.StatusBadRequest)
+		return
+	}
+	if err := rou.deleter.enqueue(r.Context(), deleteRequest{owner: owner, shorts: shorts}); err != nil {
+		storageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// updateURL() changes the full URL of the user's short URL
+
+func (rou URLRouter) updateURL(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		URL string `json:"url"`
+	}
+	owner := UserID(r.Context())
+	if owner == "" {
+		http.Error(w, "User is not authenticated", http.StatusUnauthorized)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	url, err := rou.targetURL(r.Context(), request.URL)
+	if err != nil {
+		targetError(w, err)
+		return
+	}
+	if err := rou.storer.Update(r.Context(), chi.URLParam(r, "short"), url, owner); err != nil {
+		storageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getHistory() replies with the full URLs the user's short URL has had, the current
+// one last
+
+func (rou URLRouter) getHistory(w http.ResponseWriter, r *http.Request) {
+	type item struct {
+		Version     int64      `json:"version"`
+		OriginalURL string     `json:"original_url"`
+		ReplacedAt  *time.Time `json:"replaced_at,omitempty"`
+	}
+	var response struct {
+		ShortURL string `json:"short_url"`
+		History  []item `json:"history"`
+	}
+	owner := UserID(r.Context())
+	if owner == "" {
+		http.Error(w, "User is not authenticated", http.StatusUnauthorized)
+		return
+	}
+	short := chi.URLParam(r, "short")
+	revisions, err := rou.storer.History(r.Context(), short, owner)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	response.ShortURL = fmt.Sprintf("%s/%s", rou.baseURL, short)
+	response.History = make([]item, len(revisions))
+	for i, rev := range revisions {
+		response.History[i] = item{Version: rev.Version, OriginalURL: rev.URL}
+		if !rev.ReplacedAt.IsZero() {
+			replacedAt := rev.ReplacedAt.UTC()
+			response.History[i].ReplacedAt = &replacedAt
+		}
+	}
+	w.Header().Set(headerContentType, "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// ping() checks the store, /healthz is only about the server being alive, and /readyz
+// is about both the server taking requests and the store
+
+func (rou URLRouter) ping(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), pingTimeout)
+	defer cancel()
+	if err := rou.storer.Ping(ctx); err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (rou URLRouter) readyz(w http.ResponseWriter, r *http.Request) {
+	if !rou.ready.Load() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	rou.ping(w, r)
+}
+
 func (rou URLRouter) getURL(w http.ResponseWriter, r *http.Request) {
 	short := chi.URLParam(r, "short")
 	if short == "" {
 		http.Error(w, "Short URL identificator is missing", http.StatusBadRequest)
 		return
 	}
-	url, err := rou.storer.Get(short)
+
+	// The link may have been added before its full URL was denied. The policy is checked
+	// before Get(), so that denied redirects do not use up the clicks. The full URL is
+	// checked again if it has been changed in between.
+	//
+	checked := ""
+	if rou.policy != nil {
+		url, err := rou.storer.Lookup(r.Context(), short)
+		if err != nil {
+			storageError(w, err)
+			return
+		}
+		if err := rou.policy.Check(url); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		checked = url
+	}
+	url, err := rou.storer.Get(r.Context(), short)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		storageError(w, err)
 		return
 	}
+	if rou.policy != nil && url != checked {
+		if err := rou.policy.Check(url); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	rou.recorder.click(r, short)
 	w.Header().Set(headerLocation, url)
 	w.WriteHeader(http.StatusTemporaryRedirect)
 }
+
+// getStats() replies with the redirects of the user's short URL: the total, by days
+// (oldest first) and by referrers (most frequent first, the empty one is for direct
+// visits)
+
+func (rou URLRouter) getStats(w http.ResponseWriter, r *http.Request) {
+	type day struct {
+		Date   string `json:"date"`
+		Clicks int64  `json:"clicks"`
+	}
+	type referrer struct {
+		Referrer string `json:"referrer"`
+		Clicks   int64  `json:"clicks"`
+	}
+	var response struct {
+		ShortURL  string     `json:"short_url"`
+		Total     int64      `json:"total"`
+		Days      []day      `json:"days"`
+		Referrers []referrer `json:"referrers"`
+	}
+	owner := UserID(r.Context())
+	if owner == "" {
+		http.Error(w, "User is not authenticated", http.StatusUnauthorized)
+		return
+	}
+	short := chi.URLParam(r, "short")
+	stats, err := rou.storer.Stats(r.Context(), short, owner)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	response.ShortURL = fmt.Sprintf("%s/%s", rou.baseURL, short)
+	response.Total = stats.Total
+	response.Days = make([]day, 0, len(stats.Days))
+	for date, n := range stats.Days {
+		response.Days = append(response.Days, day{Date: date, Clicks: n})
+	}
+	sort.Slice(response.Days, func(i, j int) bool {
+		return response.Days[i].Date < response.Days[j].Date
+	})
+	response.Referrers = make([]referrer, 0, len(stats.Referrers))
+	for host, n := range stats.Referrers {
+		response.Referrers = append(response.Referrers, referrer{Referrer: host, Clicks: n})
+	}
+	sort.Slice(response.Referrers, func(i, j int) bool {
+		a, b := response.Referrers[i], response.Referrers[j]
+		return a.Clicks > b.Clicks || a.Clicks == b.Clicks && a.Referrer < b.Referrer
+	})
+	w.Header().Set(headerContentType, "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
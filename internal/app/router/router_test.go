@@ -2,15 +2,21 @@ package router
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/require"
+
+	"github.com/nickeroshenkov/urlShortener/internal/app/storage"
 )
 
 type inputProvided struct {
@@ -19,6 +25,7 @@ type inputProvided struct {
 	body     []byte
 	compress bool              // true to allow server to compress the response
 	store    map[string]string // nil is not allowed -- always initialize
+	err      error             // non-nil to make the storage mock fail with it
 }
 
 type outputDesired struct {
@@ -83,6 +90,102 @@ var tests = []struct {
 			store: map[string]string{"100": "http://www.google.com", "1": "http://www.yandex.ru"},
 		},
 	},
+	{
+		name: "Add new URL with an alias via API",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/api/shorten",
+			body:     []byte("{\"url\":\"http://www.google.com\",\"alias\":\"spring-sale\"}"),
+			compress: false,
+			store:    map[string]string{"100": "http://www.google.com"},
+		},
+		o: outputDesired{
+			code:   http.StatusCreated,
+			header: map[string]string{"Content-Type": "application/json"},
+			body:   []byte("{\"result\":\"http://server:port/spring-sale\"}\n"),
+			store:  map[string]string{"100": "http://www.google.com", "spring-sale": "http://www.google.com"},
+		},
+	},
+	{
+		name: "Try to add new URL with a taken alias via API",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/api/shorten",
+			body:     []byte("{\"url\":\"http://www.yandex.ru\",\"alias\":\"spring-sale\"}"),
+			compress: false,
+			store:    map[string]string{"spring-sale": "http://www.google.com"},
+		},
+		o: outputDesired{
+			code:   http.StatusConflict,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{"spring-sale": "http://www.google.com"},
+		},
+	},
+	{
+		name: "Try to add new URL with an invalid alias via API",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/api/shorten",
+			body:     []byte("{\"url\":\"http://www.yandex.ru\",\"alias\":\"spring sale\"}"),
+			compress: false,
+			store:    map[string]string{},
+		},
+		o: outputDesired{
+			code:   http.StatusBadRequest,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Try to add new URL with a too short alias via API",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/api/shorten",
+			body:     []byte("{\"url\":\"http://www.yandex.ru\",\"alias\":\"ab\"}"),
+			compress: false,
+			store:    map[string]string{},
+		},
+		o: outputDesired{
+			code:   http.StatusBadRequest,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Try to add new URL with a reserved alias via API",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/api/shorten",
+			body:     []byte("{\"url\":\"http://www.yandex.ru\",\"alias\":\"Ping\"}"),
+			compress: false,
+			store:    map[string]string{},
+		},
+		o: outputDesired{
+			code:   http.StatusBadRequest,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Try to add new URL with another reserved alias via API",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/api/shorten",
+			body:     []byte("{\"url\":\"http://www.yandex.ru\",\"alias\":\"api\"}"),
+			compress: false,
+			store:    map[string]string{},
+		},
+		o: outputDesired{
+			code:   http.StatusBadRequest,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
 	{
 		name: "Add new URL via API #2 (with compression)",
 		i: inputProvided{
@@ -110,12 +213,28 @@ var tests = []struct {
 			store:    map[string]string{"100": "http://www.google.com", "101": "http://www.yandex.ru"},
 		},
 		o: outputDesired{
-			code:   http.StatusCreated,
+			code:   http.StatusConflict,
 			header: map[string]string{"Content-Type": "application/json"},
 			body:   []byte("{\"result\":\"http://server:port/100\"}\n"),
 			store:  map[string]string{"100": "http://www.google.com", "101": "http://www.yandex.ru"},
 		},
 	},
+	{
+		name: "Add an already existing URL",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/",
+			body:     []byte("http://www.yandex.ru"),
+			compress: false,
+			store:    map[string]string{"100": "http://www.google.com", "101": "http://www.yandex.ru"},
+		},
+		o: outputDesired{
+			code:   http.StatusConflict,
+			header: nil,
+			body:   []byte("http://server:port/101"),
+			store:  map[string]string{"100": "http://www.google.com", "101": "http://www.yandex.ru"},
+		},
+	},
 	{
 		name: "Try to get a non-existing URL #1",
 		i: inputProvided{
@@ -126,7 +245,7 @@ var tests = []struct {
 			store:    map[string]string{},
 		},
 		o: outputDesired{
-			code:   http.StatusBadRequest,
+			code:   http.StatusNotFound,
 			header: nil,
 			body:   nil,
 			store:  nil,
@@ -142,7 +261,7 @@ var tests = []struct {
 			store:    map[string]string{"54321": "http://www.google.com"},
 		},
 		o: outputDesired{
-			code:   http.StatusBadRequest,
+			code:   http.StatusNotFound,
 			header: nil,
 			body:   nil,
 			store:  nil,
@@ -180,45 +299,693 @@ var tests = []struct {
 			store:  nil,
 		},
 	},
+	{
+		name: "Try to get a full URL from an unavailable store",
+		i: inputProvided{
+			method:   http.MethodGet,
+			path:     "/abc",
+			body:     nil,
+			compress: false,
+			store:    map[string]string{"abc": "http://www.google.com"},
+			err:      storage.ErrUnavailable,
+		},
+		o: outputDesired{
+			code:   http.StatusServiceUnavailable,
+			header: nil,
+			body:   nil,
+			store:  nil,
+		},
+	},
+	{
+		name: "Try to add new URL to an unavailable store",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/",
+			body:     []byte("http://www.google.com"),
+			compress: false,
+			store:    map[string]string{},
+			err:      storage.ErrUnavailable,
+		},
+		o: outputDesired{
+			code:   http.StatusServiceUnavailable,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Try to add new URL via API with a conflict",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/api/shorten",
+			body:     []byte("{\"url\":\"http://www.google.com\"}"),
+			compress: false,
+			store:    map[string]string{},
+			err:      storage.ErrConflict,
+		},
+		o: outputDesired{
+			code:   http.StatusConflict,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Try to add new URL with an unknown store error",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/",
+			body:     []byte("http://www.google.com"),
+			compress: false,
+			store:    map[string]string{},
+			err:      errors.New("unknown error"),
+		},
+		o: outputDesired{
+			code:   http.StatusInternalServerError,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Add a batch of URLs via API",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/api/shorten/batch",
+			body:     []byte("[{\"correlation_id\":\"a\",\"original_url\":\"http://www.yandex.ru\"},{\"correlation_id\":\"b\",\"original_url\":\"http://www.google.com\"}]"),
+			compress: false,
+			store:    map[string]string{"100": "http://www.google.com"},
+		},
+		o: outputDesired{
+			code:   http.StatusCreated,
+			header: map[string]string{"Content-Type": "application/json"},
+			body:   []byte("[{\"correlation_id\":\"a\",\"short_url\":\"http://server:port/1\"},{\"correlation_id\":\"b\",\"short_url\":\"http://server:port/100\"}]\n"),
+			store:  map[string]string{"100": "http://www.google.com", "1": "http://www.yandex.ru"},
+		},
+	},
+	{
+		name: "Add an equivalent URL",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/",
+			body:     []byte(" HTTP://WWW.Google.COM:80/\n"),
+			compress: false,
+			store:    map[string]string{"100": "http://www.google.com"},
+		},
+		o: outputDesired{
+			code:   http.StatusConflict,
+			header: nil,
+			body:   []byte("http://server:port/100"),
+			store:  map[string]string{"100": "http://www.google.com"},
+		},
+	},
+	{
+		name: "Try to add a javascript URL",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/",
+			body:     []byte("javascript:alert(1)"),
+			compress: false,
+			store:    map[string]string{},
+		},
+		o: outputDesired{
+			code:   http.StatusBadRequest,
+			header: nil,
+			body:   []byte("URL scheme \"javascript\" is not allowed, only http and https are\n"),
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Try to add an empty URL via API",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/api/shorten",
+			body:     []byte("{\"url\":\" \"}"),
+			compress: false,
+			store:    map[string]string{},
+		},
+		o: outputDesired{
+			code:   http.StatusBadRequest,
+			header: nil,
+			body:   []byte("URL is empty\n"),
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Try to add a batch with an invalid URL via API",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/api/shorten/batch",
+			body:     []byte("[{\"correlation_id\":\"a\",\"original_url\":\"http://www.yandex.ru\"},{\"correlation_id\":\"b\",\"original_url\":\"www.google.com\"}]"),
+			compress: false,
+			store:    map[string]string{},
+		},
+		o: outputDesired{
+			code:   http.StatusBadRequest,
+			header: nil,
+			body:   []byte("URL must be absolute, e.g. https://example.com (correlation_id \"b\")\n"),
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Try to add an empty batch of URLs via API",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/api/shorten/batch",
+			body:     []byte("[]"),
+			compress: false,
+			store:    map[string]string{},
+		},
+		o: outputDesired{
+			code:   http.StatusBadRequest,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Try to add a malformed batch of URLs via API",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/api/shorten/batch",
+			body:     []byte("{\"url\":\"http://www.google.com\"}"),
+			compress: false,
+			store:    map[string]string{},
+		},
+		o: outputDesired{
+			code:   http.StatusBadRequest,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Try to add a batch of URLs to an unavailable store",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/api/shorten/batch",
+			body:     []byte("[{\"correlation_id\":\"a\",\"original_url\":\"http://www.yandex.ru\"}]"),
+			compress: false,
+			store:    map[string]string{},
+			err:      storage.ErrUnavailable,
+		},
+		o: outputDesired{
+			code:   http.StatusServiceUnavailable,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Ping an available store",
+		i: inputProvided{
+			method:   http.MethodGet,
+			path:     "/ping",
+			body:     nil,
+			compress: false,
+			store:    map[string]string{},
+			err:      nil,
+		},
+		o: outputDesired{
+			code:   http.StatusOK,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Ping an unavailable store",
+		i: inputProvided{
+			method:   http.MethodGet,
+			path:     "/ping",
+			body:     nil,
+			compress: false,
+			store:    map[string]string{},
+			err:      storage.ErrUnavailable,
+		},
+		o: outputDesired{
+			code:   http.StatusInternalServerError,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Check the liveness with an unavailable store",
+		i: inputProvided{
+			method:   http.MethodGet,
+			path:     "/healthz",
+			body:     nil,
+			compress: false,
+			store:    map[string]string{},
+			err:      storage.ErrUnavailable,
+		},
+		o: outputDesired{
+			code:   http.StatusOK,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Check the readiness with an available store",
+		i: inputProvided{
+			method:   http.MethodGet,
+			path:     "/readyz",
+			body:     nil,
+			compress: false,
+			store:    map[string]string{},
+			err:      nil,
+		},
+		o: outputDesired{
+			code:   http.StatusOK,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Check the readiness with an unavailable store",
+		i: inputProvided{
+			method:   http.MethodGet,
+			path:     "/readyz",
+			body:     nil,
+			compress: false,
+			store:    map[string]string{},
+			err:      storage.ErrUnavailable,
+		},
+		o: outputDesired{
+			code:   http.StatusInternalServerError,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Add new URL with the expiration via API",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/api/shorten",
+			body:     []byte("{\"url\":\"http://www.google.com\",\"expires_at\":\"2100-01-01T00:00:00Z\",\"max_clicks\":10}"),
+			compress: false,
+			store:    map[string]string{},
+			err:      nil,
+		},
+		o: outputDesired{
+			code:   http.StatusCreated,
+			header: nil,
+			body:   []byte("{\"result\":\"http://server:port/1\"}\n"),
+			store:  map[string]string{"1": "http://www.google.com"},
+		},
+	},
+	{
+		name: "Try to add new URL with the expiration in the past via API",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/api/shorten",
+			body:     []byte("{\"url\":\"http://www.google.com\",\"expires_at\":\"2000-01-01T00:00:00Z\"}"),
+			compress: false,
+			store:    map[string]string{},
+			err:      nil,
+		},
+		o: outputDesired{
+			code:   http.StatusBadRequest,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Try to add new URL with an invalid expiration via API",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/api/shorten",
+			body:     []byte("{\"url\":\"http://www.google.com\",\"expires_at\":\"tomorrow\"}"),
+			compress: false,
+			store:    map[string]string{},
+			err:      nil,
+		},
+		o: outputDesired{
+			code:   http.StatusBadRequest,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Try to add new URL with negative max clicks via API",
+		i: inputProvided{
+			method:   http.MethodPost,
+			path:     "/api/shorten",
+			body:     []byte("{\"url\":\"http://www.google.com\",\"max_clicks\":-1}"),
+			compress: false,
+			store:    map[string]string{},
+			err:      nil,
+		},
+		o: outputDesired{
+			code:   http.StatusBadRequest,
+			header: nil,
+			body:   nil,
+			store:  map[string]string{},
+		},
+	},
+	{
+		name: "Try to get an expired full URL",
+		i: inputProvided{
+			method:   http.MethodGet,
+			path:     "/abc",
+			body:     nil,
+			compress: false,
+			store:    map[string]string{"abc": "http://www.google.com"},
+			err:      storage.ErrExpired,
+		},
+		o: outputDesired{
+			code:   http.StatusGone,
+			header: nil,
+			body:   nil,
+			store:  nil,
+		},
+	},
 }
 
 // This is a mock storage for test purposes using URLStorer interface. It implements
 // the most simple approach with a memory-based map and a counter. The mock can also
 // access the map directly without Add() / Get() for a faster test setup and checks.
+// The mutex is for the deletions, which come from the background workers.
 
 type urlStoreMock struct {
-	i uint32
-	s map[string]string
+	mu  sync.Mutex
+	i   uint32
+	s   map[string]string
+	o   map[string]string             // owners of the short URLs, nil means do not keep them
+	d   map[string]bool               // deleted short URLs, nil means none are deleted yet
+	c   []storage.Click               // recorded clicks
+	h   map[string][]storage.Revision // former full URLs, nil means none are changed yet
+	k   []storage.APIKey              // API keys in the order they have been added in
+	n   map[string]int                // redirects counted by Get(), nil means do not count them
+	r   map[string]bool               // names the router has reserved
+	err error
 }
 
-func (store *urlStoreMock) Add(url string) (string, error) {
+func (store *urlStoreMock) Add(ctx context.Context, url, owner string) (string, bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.err != nil {
+		return "", false, store.err
+	}
 	for k, v := range store.s {
 		if v == url {
-			return k, nil
+			return k, false, nil
 		}
 	}
 	store.i++
 	short := strconv.FormatUint(uint64(store.i), 10)
 	store.s[short] = url
-	return short, nil
+	if store.o != nil {
+		store.o[short] = owner
+	}
+	return short, true, nil
+}
+
+func (store *urlStoreMock) AddBatch(ctx context.Context, urls []string, owner string) ([]string, error) {
+	shorts := make([]string, len(urls))
+	for i, url := range urls {
+		short, _, err := store.Add(ctx, url, owner)
+		if err != nil {
+			return nil, err
+		}
+		shorts[i] = short
+	}
+	return shorts, nil
+}
+
+// AddWithOptions() keeps the alias only, the expiration is not tested with the mock
+
+func (store *urlStoreMock) AddWithOptions(ctx context.Context, url, owner string, opts storage.AddOptions) (string, bool, error) {
+	if opts.Alias == "" {
+		return store.Add(ctx, url, owner)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.err != nil {
+		return "", false, store.err
+	}
+	if _, ok := store.s[opts.Alias]; ok {
+		return "", false, storage.ErrConflict
+	}
+	store.s[opts.Alias] = url
+	if store.o != nil {
+		store.o[opts.Alias] = owner
+	}
+	return opts.Alias, true, nil
+}
+
+func (store *urlStoreMock) ListByOwner(ctx context.Context, owner string, opts storage.ListOptions) ([]storage.Link, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.err != nil {
+		return nil, store.err
+	}
+	links := []storage.Link{}
+	for i := uint32(1); i <= store.i; i++ {
+		short := strconv.FormatUint(uint64(i), 10)
+		if store.o[short] == owner && !store.d[short] {
+			links = append(links, storage.Link{Short: short, URL: store.s[short]})
+		}
+	}
+	if opts.Offset >= len(links) {
+		return []storage.Link{}, nil
+	}
+	links = links[opts.Offset:]
+	if opts.Limit < len(links) {
+		links = links[:opts.Limit]
+	}
+	return links, nil
+}
+
+func (store *urlStoreMock) DeleteBatch(ctx context.Context, shorts []string, owner string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.err != nil {
+		return store.err
+	}
+	if store.d == nil {
+		store.d = map[string]bool{}
+	}
+	for _, short := range shorts {
+		if store.o[short] == owner {
+			store.d[short] = true
+		}
+	}
+	return nil
 }
 
-func (store *urlStoreMock) Get(short string) (string, error) {
+func (store *urlStoreMock) Get(ctx context.Context, short string) (string, error) {
+	url, err := store.Lookup(ctx, short)
+	if err == nil && store.n != nil {
+		store.mu.Lock()
+		store.n[short]++
+		store.mu.Unlock()
+	}
+	return url, err
+}
+
+func (store *urlStoreMock) Lookup(ctx context.Context, short string) (string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.err != nil {
+		return "", store.err
+	}
 	url, ok := store.s[short]
 	if !ok {
-		return "", errors.New("URL does not exist in the store")
+		return "", storage.ErrNotFound
+	}
+	if store.d[short] {
+		return "", storage.ErrDeleted
 	}
 	return url, nil
 }
 
+func (store *urlStoreMock) AddKey(ctx context.Context, key storage.APIKey) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.err != nil {
+		return store.err
+	}
+	store.k = append(store.k, key)
+	return nil
+}
+
+func (store *urlStoreMock) GetKey(ctx context.Context, hash string) (storage.APIKey, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.err != nil {
+		return storage.APIKey{}, store.err
+	}
+	for _, key := range store.k {
+		if key.Hash == hash {
+			return key, nil
+		}
+	}
+	return storage.APIKey{}, storage.ErrNotFound
+}
+
+func (store *urlStoreMock) ListKeys(ctx context.Context) ([]storage.APIKey, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return append([]storage.APIKey{}, store.k...), store.err
+}
+
+func (store *urlStoreMock) RevokeKey(ctx context.Context, id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.err != nil {
+		return store.err
+	}
+	for i := range store.k {
+		if store.k[i].ID == id {
+			store.k[i].Revoked = true
+			return nil
+		}
+	}
+	return storage.ErrNotFound
+}
+
+func (store *urlStoreMock) PurgeExpired(ctx context.Context) (int, error) {
+	return 0, store.err
+}
+
+func (store *urlStoreMock) AddClicks(ctx context.Context, clicks []storage.Click) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.err != nil {
+		return store.err
+	}
+	store.c = append(store.c, clicks...)
+	return nil
+}
+
+func (store *urlStoreMock) Stats(ctx context.Context, short, owner string) (storage.Stats, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.err != nil {
+		return storage.Stats{}, store.err
+	}
+	if _, ok := store.s[short]; !ok {
+		return storage.Stats{}, storage.ErrNotFound
+	}
+	if owner == "" || store.o[short] != owner {
+		return storage.Stats{}, storage.ErrForbidden
+	}
+	stats := storage.Stats{Days: map[string]int64{}, Referrers: map[string]int64{}}
+	for _, c := range store.c {
+		if c.Short == short {
+			stats.Total++
+			stats.Days[c.Time.UTC().Format("2006-01-02")]++
+			stats.Referrers[c.Referrer]++
+		}
+	}
+	return stats, nil
+}
+
+func (store *urlStoreMock) Update(ctx context.Context, short, url, owner string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.err != nil {
+		return store.err
+	}
+	if _, ok := store.s[short]; !ok {
+		return storage.ErrNotFound
+	}
+	if owner == "" || store.o[short] != owner {
+		return storage.ErrForbidden
+	}
+	if store.h == nil {
+		store.h = map[string][]storage.Revision{}
+	}
+	store.h[short] = append(store.h[short], storage.Revision{
+		Version:    int64(len(store.h[short]) + 1),
+		URL:        store.s[short],
+		ReplacedAt: time.Now(),
+	})
+	store.s[short] = url
+	return nil
+}
+
+func (store *urlStoreMock) History(ctx context.Context, short, owner string) ([]storage.Revision, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.err != nil {
+		return nil, store.err
+	}
+	if _, ok := store.s[short]; !ok {
+		return nil, storage.ErrNotFound
+	}
+	if owner == "" || store.o[short] != owner {
+		return nil, storage.ErrForbidden
+	}
+	revisions := append([]storage.Revision{}, store.h[short]...)
+	return append(revisions, storage.Revision{Version: int64(len(revisions) + 1), URL: store.s[short]}), nil
+}
+
+func (store *urlStoreMock) Reserve(names map[string]bool) {
+	store.r = names
+}
+
+func (store *urlStoreMock) Ping(ctx context.Context) error {
+	return store.err
+}
+
 func (store *urlStoreMock) Close() error {
 	return nil
 }
 
+// testClient does not follow redirects, so the tests get the redirects themselves
+
+var testClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// send() makes the request with testClient and returns the response along with its
+// body (the body of the response is read and closed). The cookie may be nil, and the
+// header is given in name and value pairs, the ones with empty values are skipped.
+
+func send(t *testing.T, method, url, body string, cookie *http.Cookie, header ...string) (*http.Response, string) {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		if header[i+1] != "" {
+			request.Header.Set(header[i], header[i+1])
+		}
+	}
+	response, err := testClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	b, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	return response, string(b)
+}
+
+func TestReserve(t *testing.T) {
+	// The store must not generate the short URLs the router serves other paths at
+	//
+	store := urlStoreMock{i: 0, s: map[string]string{}}
+	New("http://localhost:8080", chi.NewRouter(), &store)
+	for _, name := range []string{"api", "ping", "healthz", "readyz"} {
+		require.True(t, store.r[name], name)
+	}
+	require.NotContains(t, store.r, "{short}")
+}
+
 func TestSetRoute(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			store := urlStoreMock{i: 0, s: tt.i.store}
+			store := urlStoreMock{i: 0, s: tt.i.store, err: tt.i.err}
 			router := chi.NewRouter()
 
 			router.Use(DecompressRequest) // For gzip compression testing
@@ -239,15 +1006,9 @@ func TestSetRoute(t *testing.T) {
 				request.Header.Del("Accept-Encoding")
 			}
 
-			// Provide CheckRedirect() to modify client's behavior for re-directs
+			// Use testClient, which does not follow re-directs
 			//
-			client := &http.Client{
-				CheckRedirect: func(req *http.Request, via []*http.Request) error {
-					return http.ErrUseLastResponse
-				},
-			}
-
-			response, err := client.Do(request)
+			response, err := testClient.Do(request)
 			require.NoError(t, err)
 
 			// Check the response status code
@@ -302,3 +1063,34 @@ func TestSetRoute(t *testing.T) {
 		})
 	}
 }
+
+func TestReadiness(t *testing.T) {
+	store := urlStoreMock{i: 0, s: map[string]string{}}
+	router := chi.NewRouter()
+	rou := New("http://server:port", router, &store)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// The server is ready at once, and not ready once the shutdown has started, though
+	// it is still alive
+	//
+	for _, tt := range []struct {
+		ready bool
+		path  string
+		code  int
+	}{
+		{true, "/readyz", http.StatusOK},
+		{false, "/readyz", http.StatusServiceUnavailable},
+		{false, "/healthz", http.StatusOK},
+		{false, "/ping", http.StatusOK},
+		{true, "/readyz", http.StatusOK},
+	} {
+		rou.SetReady(tt.ready)
+		response, err := http.Get(server.URL + tt.path)
+		require.NoError(t, err)
+		response.Body.Close()
+		if response.StatusCode != tt.code {
+			t.Errorf("Expected status code %d for %s, but got %d", tt.code, tt.path, response.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/nickeroshenkov/urlShortener/internal/app/storage"
+)
+
+// Full URLs pointing back at this service (its base URL host or any of the alias
+// hosts, on any port, as the service may be reached through proxies) are resolved to
+// the full URLs they lead to, so that short URLs never lead to other short URLs. Such
+// chains could only have been stored before, and the resolution gives up after a few
+// short URLs, so it also stops on loops. Other URLs of the service (e.g. the API ones)
+// and the short URLs which do not work are rejected.
+
+const maxChainDepth = 5
+
+// selfHosts() collects the host names of the service in the canonical form, and the
+// path the short URLs are under
+
+func selfHosts(baseURL string, aliasHosts []string) (map[string]bool, string) {
+	hosts := map[string]bool{}
+	add := func(host string) {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host, err := canonicalHost(strings.Trim(host, "[]")); err == nil && host != "" {
+			hosts[host] = true
+		}
+	}
+	var path string
+	if u, err := url.Parse(baseURL); err == nil {
+		add(u.Hostname())
+		path = strings.TrimSuffix(u.Path, "/")
+	}
+	for _, host := range aliasHosts {
+		add(strings.TrimSpace(host))
+	}
+	return hosts, path
+}
+
+// resolveURL() takes the URL in the canonical form. Errors of the store are returned
+// as they are, and the other ones are about the URL.
+
+func (rou URLRouter) resolveURL(ctx context.Context, target string) (string, error) {
+	for depth := 0; ; depth++ {
+		short, ok, err := rou.selfShort(target)
+		if err != nil || !ok {
+			return target, err
+		}
+		if depth == maxChainDepth {
+			return "", fmt.Errorf("URL leads through more than %d short URLs", maxChainDepth)
+		}
+		target, err = rou.storer.Lookup(ctx, short)
+		switch {
+		case errors.Is(err, storage.ErrNotFound), errors.Is(err, storage.ErrDeleted), errors.Is(err, storage.ErrExpired):
+			return "", fmt.Errorf("URL leads to short URL %q which does not work: %w", short, err)
+		case err != nil:
+			return "", err
+		}
+	}
+}
+
+// selfShort() tells whether the URL points at this service, and gives the short URL
+// it points to. The query and the fragment do not matter for short URLs. The host is
+// brought to the canonical form, as the URLs stored long ago may not have it.
+
+func (rou URLRouter) selfShort(target string) (string, bool, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", false, nil
+	}
+	if host, err := canonicalHost(u.Hostname()); err != nil || !rou.selfHosts[host] {
+		return "", false, nil
+	}
+	prefix := rou.basePath + "/"
+	short := strings.TrimPrefix(u.Path, prefix)
+	if !strings.HasPrefix(u.Path, prefix) || short == "" || strings.Contains(short, "/") || rou.reserved[strings.ToLower(short)] {
+		return "", false, errors.New("URL points at this service, but not at a short URL")
+	}
+	return short, true, nil
+}
+
+// targetURL() brings the full URL given by the user to the form it is stored in, and
+// checks it against the policy
+
+func (rou URLRouter) targetURL(ctx context.Context, raw string) (string, error) {
+	target, err := canonicalURL(raw)
+	if err != nil {
+		return "", err
+	}
+	if target, err = rou.resolveURL(ctx, target); err != nil {
+		return "", err
+	}
+	if rou.policy != nil {
+		if err := rou.policy.Check(target); err != nil {
+			return "", &deniedError{err}
+		}
+	}
+	return target, nil
+}
+
+// deniedError marks the URLs denied by the policy
+
+type deniedError struct {
+	error
+}
+
+func (e *deniedError) Unwrap() error {
+	return e.error
+}
+
+// targetError() replies to the request with the status matching the error of
+// targetURL()
+
+func targetError(w http.ResponseWriter, err error) {
+	var denied *deniedError
+	switch {
+	case errors.As(err, &denied):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, storage.ErrUnavailable), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		storageError(w, err)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
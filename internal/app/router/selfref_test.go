@@ -0,0 +1,120 @@
+package router
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nickeroshenkov/urlShortener/internal/app/storage"
+)
+
+func TestSelfHosts(t *testing.T) {
+	hosts, path := selfHosts("https://Short.example.com.:8443/s/", []string{" sho.rt. ", "Пример.рф:80", "[::1]:8080", ""})
+	assert.Equal(t, map[string]bool{
+		"short.example.com":     true,
+		"sho.rt":                true,
+		"xn--e1afmkfd.xn--p1ai": true,
+		"::1":                   true,
+	}, hosts)
+	assert.Equal(t, "/s", path)
+
+	// Hosts in real use which the strict IDNA profile rejects are taken too
+	//
+	hosts, path = selfHosts("http://my_short.example", []string{"r4---sn-short.example:8080"})
+	assert.Equal(t, map[string]bool{
+		"my_short.example":      true,
+		"r4---sn-short.example": true,
+	}, hosts)
+	assert.Equal(t, "", path)
+}
+
+func TestResolveURL(t *testing.T) {
+	store := urlStoreMock{i: 0, s: map[string]string{
+		"1": "http://www.google.com",
+		"2": "http://short.example:8080/1",
+		"3": "http://sho.rt./4",
+		"4": "http://short.example/3",
+		"5": "http://www.yandex.ru",
+	}, d: map[string]bool{"5": true}}
+	rou := New("http://short.example:8080", chi.NewRouter(), &store, "sho.rt")
+	ctx := context.Background()
+
+	// URLs of short URLs are resolved through the chains, and the other ones are kept
+	//
+	for raw, want := range map[string]string{
+		"http://www.google.com":         "http://www.google.com",
+		"http://short.example:8080/1":   "http://www.google.com",
+		"https://SHORT.example/1?a=b#c": "http://www.google.com",
+		"http://sho.rt/2":               "http://www.google.com",
+		"http://short.example.:8080/1":  "http://www.google.com",
+		"http://SHO.RT./2":              "http://www.google.com",
+		"http://www.short.example/1":    "http://www.short.example/1",
+	} {
+		got, err := rou.targetURL(ctx, raw)
+		require.NoError(t, err, raw)
+		assert.Equal(t, want, got, raw)
+	}
+
+	// Loops, other URLs of the service and short URLs which do not work are rejected
+	//
+	for raw, reason := range map[string]string{
+		"http://sho.rt/3":                    "more than",
+		"http://short.example/":              "not at a short URL",
+		"http://short.example./ping":         "not at a short URL",
+		"http://short.example/api/user/urls": "not at a short URL",
+		"http://short.example/ping":          "not at a short URL",
+		"http://short.example/9":             "does not work",
+		"http://short.example/5":             "does not work",
+	} {
+		_, err := rou.targetURL(ctx, raw)
+		if assert.Error(t, err, raw) {
+			assert.Contains(t, err.Error(), reason, raw)
+		}
+	}
+
+	store.err = storage.ErrUnavailable
+	_, err := rou.targetURL(ctx, "http://short.example/1")
+	assert.ErrorIs(t, err, storage.ErrUnavailable)
+	_, err = rou.targetURL(ctx, "http://www.google.com")
+	assert.NoError(t, err)
+}
+
+func TestAddSelfReferentialURL(t *testing.T) {
+	store := urlStoreMock{i: 0, s: map[string]string{}}
+	router := chi.NewRouter()
+	New("http://short.example:8080", router, &store)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	post := func(body string) (int, string) {
+		response, err := http.Post(server.URL+"/", "text/plain", strings.NewReader(body))
+		require.NoError(t, err)
+		defer response.Body.Close()
+		b, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		return response.StatusCode, string(b)
+	}
+
+	code, body := post("http://www.google.com")
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "http://short.example:8080/1", body)
+
+	// Shortening the short URL gives the same short URL back
+	//
+	code, body = post("http://short.example:8080/1")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, "http://short.example:8080/1", body)
+	code, body = post("http://short.example.:8080/1")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, "http://short.example:8080/1", body)
+	code, _ = post("http://short.example:8080/api/shorten")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, map[string]string{"1": "http://www.google.com"}, store.s)
+}
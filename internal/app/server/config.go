@@ -1,44 +1,231 @@
 package server
 
 import (
-	"os"
 	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/nickeroshenkov/urlShortener/internal/app/storage"
 )
 
 const (
 	defaultServerAddress = "localhost:8080"
 	defaultBaseURL       = "http://localhost:8080"
+	defaultIDGenerator   = storage.GeneratorHash
+	defaultIDLength      = 8
+	defaultCompactEvery  = time.Minute
+	defaultCompactSize   = 1 << 20
+	defaultCompactRatio  = 0.5
+	defaultDrainDelay    = 0
+	defaultSweepEvery    = time.Minute
+	defaultPolicyReload  = 10 * time.Second
+	defaultCreateRate    = 0
+	defaultCreateBurst   = 20
+	defaultRedirectRate  = 0
+	defaultRedirectBurst = 100
+	defaultRateKey       = RateKeyIP
 )
 
 type Config struct {
 	ServerAddress   *string
 	BaseURL         *string
+	AliasHosts      *string
 	FileStoragePath *string
+	DatabaseDSN     *string
+	SecretKey       *string
+	AdminKey        *string
+	IDGenerator     *string
+	IDLength        *int
+	CompactEvery    *time.Duration
+	CompactSize     *int64
+	CompactRatio    *float64
+	DrainDelay      *time.Duration
+	SweepEvery      *time.Duration
+	Blocklist       *string
+	Allowlist       *string
+	PolicyReload    *time.Duration
+	CreateRate      *float64
+	CreateBurst     *int
+	RedirectRate    *float64
+	RedirectBurst   *int
+	RateKey         *string
 }
 
+// Rate limit keys
+
+const (
+	RateKeyIP   = "ip"
+	RateKeyUser = "user"
+)
+
 func NewConfig() *Config {
 	var c Config
 
 	c.ServerAddress = flag.String("a", defaultServerAddress, "specify server address in the form server:port")
 	c.BaseURL = flag.String("b", defaultBaseURL, "specify base URL in the form http://server:port")
-	c.FileStoragePath = flag.String("f", "", "specify file storage path, empty one forces to use memory storage")
+	c.AliasHosts = flag.String("alias-hosts", "", "specify comma-separated other host names of the server, full URLs must not point at them either")
+	c.FileStoragePath = flag.String("f", "", "specify file storage path or sqlite:path for SQLite storage, empty one forces to use memory storage")
+	c.DatabaseDSN = flag.String("d", "", "specify PostgreSQL DSN, non-empty one forces to use database storage")
+	c.SecretKey = flag.String("k", "", "specify secret key to sign user cookies, empty one forces to use a random key")
+	c.AdminKey = flag.String("admin-key", "", "specify API key with the admin scope to manage other API keys, empty one forces to have none")
+	c.IDGenerator = flag.String("g", defaultIDGenerator, "specify short URL generator: hash, counter or random")
+	c.IDLength = flag.Int("l", defaultIDLength, "specify short URL length for the random generator")
+	c.CompactEvery = flag.Duration("compact-every", defaultCompactEvery, "specify how often to check the file storage for compaction, 0 disables it")
+	c.CompactSize = flag.Int64("compact-size", defaultCompactSize, "specify minimal file storage size in bytes to compact")
+	c.CompactRatio = flag.Float64("compact-ratio", defaultCompactRatio, "specify minimal share of garbage records in the file storage to compact")
+	c.DrainDelay = flag.Duration("drain-delay", defaultDrainDelay, "specify how long to report not ready before shutting down, so that load balancers stop sending requests")
+	c.SweepEvery = flag.Duration("sweep-every", defaultSweepEvery, "specify how often to purge expired links from the storage, 0 disables it")
+	c.Blocklist = flag.String("blocklist", "", "specify file of the rules for full URLs to deny, empty one denies none")
+	c.Allowlist = flag.String("allowlist", "", "specify file of the rules for full URLs to allow, empty one (or one without rules) allows all")
+	c.PolicyReload = flag.Duration("policy-reload", defaultPolicyReload, "specify how often to check the blocklist and allowlist files for changes, 0 disables it")
+	c.CreateRate = flag.Float64("create-rate", defaultCreateRate, "specify how many links per second a client may add in the long run, 0 disables the limit")
+	c.CreateBurst = flag.Int("create-burst", defaultCreateBurst, "specify how many links a client may add at once")
+	c.RedirectRate = flag.Float64("redirect-rate", defaultRedirectRate, "specify how many redirects per second a client may get in the long run, 0 disables the limit")
+	c.RedirectBurst = flag.Int("redirect-burst", defaultRedirectBurst, "specify how many redirects a client may get at once")
+	c.RateKey = flag.String("rate-key", defaultRateKey, "specify how to tell clients apart for the rate limits: ip or user")
 
 	return &c
 }
 
-func (c *Config) Parse () {
+func (c *Config) Parse() error {
 	flag.Parse()
 
 	a := os.Getenv("SERVER_ADDRESS")
 	b := os.Getenv("BASE_URL")
+	ah := os.Getenv("ALIAS_HOSTS")
 	f := os.Getenv("FILE_STORAGE_PATH")
+	d := os.Getenv("DATABASE_DSN")
+	k := os.Getenv("SECRET_KEY")
+	ak := os.Getenv("ADMIN_KEY")
+	g := os.Getenv("ID_GENERATOR")
+	l := os.Getenv("ID_LENGTH")
+	ce := os.Getenv("COMPACT_EVERY")
+	cs := os.Getenv("COMPACT_SIZE")
+	cr := os.Getenv("COMPACT_RATIO")
+	dd := os.Getenv("DRAIN_DELAY")
+	se := os.Getenv("SWEEP_EVERY")
+	bl := os.Getenv("BLOCKLIST_FILE")
+	al := os.Getenv("ALLOWLIST_FILE")
+	pr := os.Getenv("POLICY_RELOAD")
+	cra := os.Getenv("CREATE_RATE")
+	cbu := os.Getenv("CREATE_BURST")
+	rra := os.Getenv("REDIRECT_RATE")
+	rbu := os.Getenv("REDIRECT_BURST")
+	rk := os.Getenv("RATE_KEY")
 	if a != "" {
 		c.ServerAddress = &a
 	}
 	if b != "" {
 		c.BaseURL = &b
 	}
+	if ah != "" {
+		c.AliasHosts = &ah
+	}
 	if f != "" {
 		c.FileStoragePath = &f
 	}
+	if d != "" {
+		c.DatabaseDSN = &d
+	}
+	if k != "" {
+		c.SecretKey = &k
+	}
+	if ak != "" {
+		c.AdminKey = &ak
+	}
+	if g != "" {
+		c.IDGenerator = &g
+	}
+	if l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil {
+			return fmt.Errorf("ID_LENGTH: %w", err)
+		}
+		c.IDLength = &n
+	}
+	if ce != "" {
+		d, err := time.ParseDuration(ce)
+		if err != nil {
+			return fmt.Errorf("COMPACT_EVERY: %w", err)
+		}
+		c.CompactEvery = &d
+	}
+	if cs != "" {
+		n, err := strconv.ParseInt(cs, 10, 64)
+		if err != nil {
+			return fmt.Errorf("COMPACT_SIZE: %w", err)
+		}
+		c.CompactSize = &n
+	}
+	if cr != "" {
+		r, err := strconv.ParseFloat(cr, 64)
+		if err != nil {
+			return fmt.Errorf("COMPACT_RATIO: %w", err)
+		}
+		c.CompactRatio = &r
+	}
+	if dd != "" {
+		d, err := time.ParseDuration(dd)
+		if err != nil {
+			return fmt.Errorf("DRAIN_DELAY: %w", err)
+		}
+		c.DrainDelay = &d
+	}
+	if se != "" {
+		d, err := time.ParseDuration(se)
+		if err != nil {
+			return fmt.Errorf("SWEEP_EVERY: %w", err)
+		}
+		c.SweepEvery = &d
+	}
+	if bl != "" {
+		c.Blocklist = &bl
+	}
+	if al != "" {
+		c.Allowlist = &al
+	}
+	if pr != "" {
+		d, err := time.ParseDuration(pr)
+		if err != nil {
+			return fmt.Errorf("POLICY_RELOAD: %w", err)
+		}
+		c.PolicyReload = &d
+	}
+	if cra != "" {
+		r, err := strconv.ParseFloat(cra, 64)
+		if err != nil {
+			return fmt.Errorf("CREATE_RATE: %w", err)
+		}
+		c.CreateRate = &r
+	}
+	if cbu != "" {
+		n, err := strconv.Atoi(cbu)
+		if err != nil {
+			return fmt.Errorf("CREATE_BURST: %w", err)
+		}
+		c.CreateBurst = &n
+	}
+	if rra != "" {
+		r, err := strconv.ParseFloat(rra, 64)
+		if err != nil {
+			return fmt.Errorf("REDIRECT_RATE: %w", err)
+		}
+		c.RedirectRate = &r
+	}
+	if rbu != "" {
+		n, err := strconv.Atoi(rbu)
+		if err != nil {
+			return fmt.Errorf("REDIRECT_BURST: %w", err)
+		}
+		c.RedirectBurst = &n
+	}
+	if rk != "" {
+		c.RateKey = &rk
+	}
+	if *c.RateKey != RateKeyIP && *c.RateKey != RateKeyUser {
+		return fmt.Errorf("rate limit key %q is unknown, must be %s or %s", *c.RateKey, RateKeyIP, RateKeyUser)
+	}
+	return nil
 }
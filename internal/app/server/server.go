@@ -2,29 +2,66 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 
+	"github.com/nickeroshenkov/urlShortener/internal/app/policy"
 	"github.com/nickeroshenkov/urlShortener/internal/app/router"
 	"github.com/nickeroshenkov/urlShortener/internal/app/storage"
 )
 
 type URLServer struct {
 	http.Server
-	Router *router.URLRouter
+	Router     *router.URLRouter
+	drainDelay time.Duration
+	sweeper    *sweeper
+	policy     *policy.Policy
 }
 
 func New(cnf *Config) (*URLServer, error) {
 	var srv URLServer
 
-	sto, err := storage.New(*cnf.FileStoragePath)
+	// User cookies do not survive a restart unless the secret key is set
+	//
+	key := []byte(*cnf.SecretKey)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+
+	gen, err := storage.NewIDGenerator(*cnf.IDGenerator, *cnf.IDLength)
+	if err != nil {
+		return nil, err
+	}
+	// The policy is read before the store is opened, so that the store is not left open
+	// if the rules are bad
+	//
+	if *cnf.Blocklist != "" || *cnf.Allowlist != "" {
+		srv.policy, err = policy.New(*cnf.Blocklist, *cnf.Allowlist, *cnf.PolicyReload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pol := storage.CompactPolicy{
+		Interval: *cnf.CompactEvery,
+		MinSize:  *cnf.CompactSize,
+		MinRatio: *cnf.CompactRatio,
+	}
+	sto, err := storage.New(*cnf.DatabaseDSN, *cnf.FileStoragePath, gen, pol)
 	if err != nil {
+		if srv.policy != nil {
+			srv.policy.Close()
+		}
 		return nil, err
 	}
-	
+
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
@@ -32,21 +69,47 @@ func New(cnf *Config) (*URLServer, error) {
 	r.Use(middleware.Recoverer)
 	r.Use(router.DecompressRequest)
 	r.Use(router.CompressResponse)
+	r.Use(router.AuthenticateKey(sto, *cnf.AdminKey))
+	r.Use(router.Authenticate(key))
 
-	srv.Router = router.New(*cnf.BaseURL, r, sto)
+	var aliasHosts []string
+	if *cnf.AliasHosts != "" {
+		aliasHosts = strings.Split(*cnf.AliasHosts, ",")
+	}
+	srv.Router = router.New(*cnf.BaseURL, r, sto, aliasHosts...)
+	if srv.policy != nil {
+		srv.Router.SetPolicy(srv.policy)
+	}
+	srv.Router.SetRateLimits(router.RateLimits{
+		Create:   router.RateLimit{Rate: *cnf.CreateRate, Burst: *cnf.CreateBurst},
+		Redirect: router.RateLimit{Rate: *cnf.RedirectRate, Burst: *cnf.RedirectBurst},
+		ByUser:   *cnf.RateKey == RateKeyUser,
+	})
 
+	srv.sweeper = newSweeper(sto, *cnf.SweepEvery)
+	srv.drainDelay = *cnf.DrainDelay
 	srv.Addr = *cnf.ServerAddress
 	srv.Handler = r
 
 	return &srv, nil
 }
 
+// Shutdown() reports the server is not ready first, waits for the drain delay, and then
+// waits for the requests in progress before stopping the sweeper and closing the store
+
 func (srv *URLServer) Shutdown() error {
+	srv.Router.SetReady(false)
+	time.Sleep(srv.drainDelay)
+
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	if err := srv.Server.Shutdown(ctx); err != nil {
 		return err
 	}
+	srv.sweeper.Close()
+	if srv.policy != nil {
+		srv.policy.Close()
+	}
 	if err := srv.Router.Close(); err != nil {
 		return err
 	}
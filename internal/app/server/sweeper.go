@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nickeroshenkov/urlShortener/internal/app/storage"
+)
+
+// Sweeper purges the expired links from the store periodically
+
+const sweepTimeout = time.Minute
+
+type sweeper struct {
+	storer storage.URLStorer
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newSweeper(s storage.URLStorer, every time.Duration) *sweeper {
+	sw := &sweeper{
+		storer: s,
+		done:   make(chan struct{}),
+	}
+	if every > 0 {
+		sw.wg.Add(1)
+		go sw.run(every)
+	}
+	return sw
+}
+
+func (sw *sweeper) run(every time.Duration) {
+	defer sw.wg.Done()
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sw.done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), sweepTimeout)
+			n, err := sw.storer.PurgeExpired(ctx)
+			cancel()
+			if err != nil {
+				log.Println(err)
+			} else if n > 0 {
+				log.Printf("Purged %d expired links", n)
+			}
+		}
+	}
+}
+
+func (sw *sweeper) Close() {
+	close(sw.done)
+	sw.wg.Wait()
+}
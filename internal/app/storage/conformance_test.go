@@ -0,0 +1,74 @@
+package storage_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/nickeroshenkov/urlShortener/internal/app/storage"
+	"github.com/nickeroshenkov/urlShortener/internal/app/storage/storagetest"
+)
+
+// All the stores run the same conformance test suite, with each of the generators
+
+var generators = map[string]func() storage.IDGenerator{
+	storage.GeneratorHash: func() storage.IDGenerator {
+		return storage.HashGenerator{}
+	},
+	storage.GeneratorCounter: func() storage.IDGenerator {
+		return &storage.CounterGenerator{}
+	},
+	storage.GeneratorRandom: func() storage.IDGenerator {
+		return storage.RandomGenerator{Length: 8}
+	},
+}
+
+func runWithGenerators(t *testing.T, newOpener func(t *testing.T, g func() storage.IDGenerator) storagetest.Opener) {
+	for name, g := range generators {
+		g := g
+		t.Run(name, func(t *testing.T) {
+			storagetest.Run(t, func(t *testing.T) storagetest.Opener {
+				return newOpener(t, g)
+			})
+		})
+	}
+}
+
+func TestMemory(t *testing.T) {
+	runWithGenerators(t, func(t *testing.T, g func() storage.IDGenerator) storagetest.Opener {
+		opened := false
+		return func() (storage.URLStorer, error) {
+			if opened {
+				return nil, nil
+			}
+			opened = true
+			return storage.NewMemory(g())
+		}
+	})
+}
+
+func TestFile(t *testing.T) {
+	runWithGenerators(t, func(t *testing.T, g func() storage.IDGenerator) storagetest.Opener {
+		filename := filepath.Join(t.TempDir(), "test.txt")
+		return func() (storage.URLStorer, error) {
+			return storage.NewFile(filename, g(), storage.CompactPolicy{})
+		}
+	})
+}
+
+func TestSQLite(t *testing.T) {
+	runWithGenerators(t, func(t *testing.T, g func() storage.IDGenerator) storagetest.Opener {
+		filename := filepath.Join(t.TempDir(), "test.db")
+		return func() (storage.URLStorer, error) {
+			return storage.NewSQLite(filename, g())
+		}
+	})
+}
+
+func TestPostgres(t *testing.T) {
+	runWithGenerators(t, func(t *testing.T, g func() storage.IDGenerator) storagetest.Opener {
+		dsn := storage.NewPostgresDSN(t)
+		return func() (storage.URLStorer, error) {
+			return storage.NewPostgres(dsn, g())
+		}
+	})
+}
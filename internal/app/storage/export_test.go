@@ -0,0 +1,5 @@
+package storage
+
+// Exported for the conformance tests in storage_test package only
+
+var NewPostgresDSN = newPostgresDSN
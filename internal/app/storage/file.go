@@ -2,92 +2,530 @@ package storage
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-// File store impelementation. It uses a text file with string pairs:
-// - first string in a pair is a short URL
-// - second string in a pair is the corresponding full URL
-// - each string terminates with \n
+// File store impelementation. It uses an append-only text file (log):
+// - first line is the header with the format version
+// - each next line is a record with a CRC-32 checksum and a JSON object in it
+// - each line terminates with \n
+// The file is read once on start to build the in-memory index (which is the memory
+// store), and after that new records are only appended to the end of the file. A torn
+// record at the end of the file (e.g. after a crash) is detected and truncated.
+//
+// The log may contain garbage records that are no longer in the index. The store
+// checks the log periodically and compacts it according to the policy: a fresh
+// snapshot of the index is written aside and then renamed over the log. Compaction
+// holds the index write lock only for a short time to swap the files.
+
+const (
+	fileMagic   = "# urlshortener log v"
+	fileVersion = 2
+)
+
+var fileHeader = fmt.Sprintf("%s%d\n", fileMagic, fileVersion)
+
+// A batch record keeps all the records of a batch in a single line, so that either
+// the whole batch survives a crash, or none of it. Records replace and update the
+// former records of the same short URL the way the index does (see insert()). The
+// expiration time is in Unix nanoseconds. A statistics record keeps the counts of
+// redirects to add up, and a record with the history is an edit of the link. A key
+// record keeps an API key (with the hash of its secret only) and nothing else.
+
+type fileRecord struct {
+	Short     string         `json:"short_url,omitempty"`
+	URL       string         `json:"original_url,omitempty"`
+	Owner     string         `json:"owner,omitempty"`
+	Deleted   bool           `json:"deleted,omitempty"`
+	Alias     bool           `json:"alias,omitempty"`
+	Purged    bool           `json:"purged,omitempty"`
+	ExpiresAt int64          `json:"expires_at,omitempty"`
+	MaxClicks int64          `json:"max_clicks,omitempty"`
+	Clicks    int64          `json:"clicks,omitempty"`
+	Stats     *fileStats     `json:"stats,omitempty"`
+	History   []fileRevision `json:"history,omitempty"`
+	Key       *fileKey       `json:"api_key,omitempty"`
+	Batch     []fileRecord   `json:"batch,omitempty"`
+}
+
+type fileStats struct {
+	Total     int64            `json:"total"`
+	Days      map[string]int64 `json:"days,omitempty"`
+	Referrers map[string]int64 `json:"referrers,omitempty"`
+}
+
+type fileRevision struct {
+	Version    int64  `json:"version"`
+	URL        string `json:"original_url"`
+	ReplacedAt int64  `json:"replaced_at"`
+}
+
+type fileKey struct {
+	ID        string `json:"id"`
+	Hash      string `json:"key_hash"`
+	Owner     string `json:"owner"`
+	Scope     string `json:"scope"`
+	CreatedAt int64  `json:"created_at"`
+	Revoked   bool   `json:"revoked,omitempty"`
+}
+
+func encodeRecord(rec fileRecord) ([]byte, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)), nil
+}
+
+func toFileRecord(r record) fileRecord {
+	rec := fileRecord{
+		Short:     r.short,
+		URL:       r.url,
+		Owner:     r.owner,
+		Deleted:   r.deleted,
+		Alias:     r.alias,
+		Purged:    r.purged,
+		MaxClicks: r.maxClicks,
+		Clicks:    r.clicks,
+	}
+	if !r.expiresAt.IsZero() {
+		rec.ExpiresAt = r.expiresAt.UnixNano()
+	}
+	if r.stats != nil {
+		rec.Stats = &fileStats{Total: r.stats.Total, Days: r.stats.Days, Referrers: r.stats.Referrers}
+	}
+	for _, rev := range r.history {
+		rec.History = append(rec.History, fileRevision{Version: rev.Version, URL: rev.URL, ReplacedAt: rev.ReplacedAt.UnixNano()})
+	}
+	if k := r.key; k != nil {
+		rec.Key = &fileKey{ID: k.ID, Hash: k.Hash, Owner: k.Owner, Scope: k.Scope, CreatedAt: k.CreatedAt.UnixNano(), Revoked: k.Revoked}
+	}
+	return rec
+}
+
+func fromFileRecord(rec fileRecord) record {
+	r := record{
+		short:     rec.Short,
+		url:       rec.URL,
+		owner:     rec.Owner,
+		deleted:   rec.Deleted,
+		alias:     rec.Alias,
+		purged:    rec.Purged,
+		maxClicks: rec.MaxClicks,
+		clicks:    rec.Clicks,
+	}
+	if rec.ExpiresAt != 0 {
+		r.expiresAt = time.Unix(0, rec.ExpiresAt)
+	}
+	if rec.Stats != nil {
+		r.stats = newStats()
+		r.stats.merge(&Stats{Total: rec.Stats.Total, Days: rec.Stats.Days, Referrers: rec.Stats.Referrers})
+	}
+	for _, rev := range rec.History {
+		r.history = append(r.history, Revision{Version: rev.Version, URL: rev.URL, ReplacedAt: time.Unix(0, rev.ReplacedAt)})
+	}
+	if k := rec.Key; k != nil {
+		r.key = &APIKey{ID: k.ID, Hash: k.Hash, Owner: k.Owner, Scope: k.Scope, CreatedAt: time.Unix(0, k.CreatedAt), Revoked: k.Revoked}
+	}
+	return r
+}
+
+func decodeRecord(line []byte) (fileRecord, error) {
+	var rec fileRecord
+	sum, data, ok := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+	if !ok || len(sum) != 8 {
+		return rec, errors.New(errRecord)
+	}
+	crc, err := strconv.ParseUint(string(sum), 16, 32)
+	if err != nil || uint32(crc) != crc32.ChecksumIEEE(data) {
+		return rec, errors.New(errRecord)
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, errors.New(errRecord)
+	}
+	return rec, nil
+}
+
+// CompactPolicy sets when the log is compacted. The log is checked every Interval,
+// and compacted if it is at least MinSize bytes and the share of garbage records is
+// at least MinRatio. Zero Interval disables the background compaction.
+
+type CompactPolicy struct {
+	Interval time.Duration
+	MinSize  int64
+	MinRatio float64
+}
 
 type URLStoreFile struct {
-	f  *os.File
-	rw *bufio.ReadWriter
+	*URLStore
+	filename string
+	f        *os.File
+	w        *bufio.Writer
+	size     int64 // log size in bytes
+	records  int   // number of records in the log
+	cmu      sync.Mutex
+	done     chan struct{}
+	wg       sync.WaitGroup
 }
 
-func NewFile(filename string) (*URLStoreFile, error) {
+func NewFile(filename string, g IDGenerator, p CompactPolicy) (*URLStoreFile, error) {
+	if err := MigrateFile(filename); err != nil {
+		return nil, err
+	}
 	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0664)
 	if err != nil {
 		return nil, errors.New(errOpen)
 	}
-	rw := bufio.NewReadWriter(bufio.NewReader(f), bufio.NewWriter(f))
-	return &URLStoreFile{
-		f:  f,
-		rw: rw,
-	}, nil
+	index, _ := NewMemory(g)
+	store := &URLStoreFile{
+		URLStore: index,
+		filename: filename,
+		f:        f,
+		w:        bufio.NewWriter(f),
+		done:     make(chan struct{}),
+	}
+	if err := store.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	index.seed()
+	index.persist = store.append
+	if p.Interval > 0 {
+		store.wg.Add(1)
+		go store.compactor(p)
+	}
+	return store, nil
 }
 
-func (store *URLStoreFile) Add(url string) (string, error) {
-	store.f.Seek(0, 0)
-	store.rw.Reader.Reset(store.f)
-	store.rw.Writer.Reset(store.f)
+func (store *URLStoreFile) load() error {
+	r := bufio.NewReader(store.f)
+	header, err := r.ReadString('\n')
+	if header == "" && err == io.EOF {
+		if _, err := store.f.WriteString(fileHeader); err != nil {
+			return errors.New(errWrite)
+		}
+		store.size = int64(len(fileHeader))
+		return nil
+	}
+	if header != fileHeader {
+		return errors.New(errVersion)
+	}
 
-	// Check if URL has already been stored
-	//
+	offset := int64(len(header))
 	for {
-		k, err1 := store.rw.ReadString('\n')
-		v, err2 := store.rw.ReadString('\n')
-		if len(k) == 0 && err1 == io.EOF {
+		line, err := r.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
 			break
 		}
-		if err1 != nil || err2 != nil {
-			return "", errors.New(errRead)
+		if err != nil && err != io.EOF {
+			return errors.New(errRead)
+		}
+		rec, err := decodeRecord(line)
+		if err != nil || line[len(line)-1] != '\n' {
+			// Only the last record may be broken, otherwise the file is corrupted
+			//
+			if _, err := r.Peek(1); err != io.EOF {
+				return errors.New(errCorrupt)
+			}
+			if err := store.f.Truncate(offset); err != nil {
+				return errors.New(errWrite)
+			}
+			break
+		}
+		if rec.Batch == nil {
+			rec.Batch = []fileRecord{rec}
 		}
-		k = strings.TrimSpace(k)
-		v = strings.TrimSpace(v)
-		if v == url {
-			return k, nil
+		for _, rec := range rec.Batch {
+			store.insert(fromFileRecord(rec))
+			store.records++
+		}
+		offset += int64(len(line))
+	}
+	if _, err := store.f.Seek(offset, io.SeekStart); err != nil {
+		return errors.New(errRead)
+	}
+	store.size = offset
+	return nil
+}
+
+// append() is called by the index under its write lock, so the index is updated only
+// if the record has been written to the file. The record is written at once, so a
+// crash may only leave a torn record at the very end of the file.
+
+func (store *URLStoreFile) append(recs []record) error {
+	rec := toFileRecord(recs[0])
+	if len(recs) > 1 {
+		rec = fileRecord{Batch: make([]fileRecord, len(recs))}
+		for i, r := range recs {
+			rec.Batch[i] = toFileRecord(r)
 		}
 	}
+	line, err := encodeRecord(rec)
+	if err != nil {
+		return unavailable(errWrite, err)
+	}
+	if _, err := store.w.Write(line); err != nil {
+		return unavailable(errWrite, err)
+	}
+	if err := store.w.Flush(); err != nil {
+		return unavailable(errWrite, err)
+	}
+	store.size += int64(len(line))
+	store.records += len(recs)
+	return nil
+}
 
-	_, err1 := store.rw.WriteString(encode(url) + "\n")
-	_, err2 := store.rw.WriteString(url + "\n")
-	err3 := store.rw.Flush()
-	if err1 != nil || err2 != nil || err3 != nil {
-		return "", errors.New(errWrite)
+func (store *URLStoreFile) compactor(p CompactPolicy) {
+	defer store.wg.Done()
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-store.done:
+			return
+		case <-ticker.C:
+			if !store.needsCompaction(p) {
+				continue
+			}
+			if err := store.Compact(); err != nil {
+				log.Println(err)
+			}
+		}
 	}
+}
 
-	return encode(url), nil
+func (store *URLStoreFile) needsCompaction(p CompactPolicy) bool {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if store.size < p.MinSize || store.records == 0 {
+		return false
+	}
+	return float64(store.records-len(store.links)-len(store.stats)-len(store.keys))/float64(store.records) >= p.MinRatio
 }
 
-func (store *URLStoreFile) Get(short string) (string, error) {
-	store.f.Seek(0, 0)
-	store.rw.Reader.Reset(store.f)
+// Compact() copies the index, writes the copy aside without holding any lock, and
+// then (under the write lock) appends the records added meanwhile and renames the
+// snapshot over the log. The snapshot file stays open and becomes the new log.
 
-	for {
-		k, err1 := store.rw.ReadString('\n')
-		v, err2 := store.rw.ReadString('\n')
-		if len(k) == 0 && err1 == io.EOF {
-			return "", errors.New(errNoURL)
+func (store *URLStoreFile) Compact() error {
+	store.cmu.Lock()
+	defer store.cmu.Unlock()
+
+	store.mu.RLock()
+	// Keep the order of the owned short URLs, so that they are listed the same way
+	//
+	snapshot := make([]record, 0, len(store.links))
+	for _, shorts := range store.byOwner {
+		for _, short := range shorts {
+			r := store.links[short]
+			r.history = store.history[short]
+			snapshot = append(snapshot, r)
 		}
-		if err1 != nil || err2 != nil {
-			return "", errors.New(errRead)
+	}
+	for short, r := range store.links {
+		if r.owner == "" || r.deleted {
+			r.history = store.history[short]
+			snapshot = append(snapshot, r)
+		}
+	}
+	// The statistics are copied, as they are added up in place
+	//
+	for short, stats := range store.stats {
+		copied := newStats()
+		copied.merge(stats)
+		snapshot = append(snapshot, record{short: short, stats: copied})
+	}
+	for _, key := range store.keys {
+		key := key
+		snapshot = append(snapshot, record{key: &key})
+	}
+	size, records := store.size, store.records
+	store.mu.RUnlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(store.filename), ".compact-*")
+	if err != nil {
+		return errors.New(errCompact)
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	// The temporary file is only readable by its owner, so give it the mode of the log
+	//
+	info, err := store.f.Stat()
+	if err != nil {
+		return errors.New(errCompact)
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		return errors.New(errCompact)
+	}
+
+	w := bufio.NewWriter(tmp)
+	if _, err := w.WriteString(fileHeader); err != nil {
+		return errors.New(errCompact)
+	}
+	for _, r := range snapshot {
+		line, err := encodeRecord(toFileRecord(r))
+		if err != nil {
+			return errors.New(errCompact)
 		}
-		k = strings.TrimSpace(k)
-		v = strings.TrimSpace(v)
-		if k == short {
-			return v, nil
+		if _, err := w.Write(line); err != nil {
+			return errors.New(errCompact)
 		}
 	}
+	if err := w.Flush(); err != nil {
+		return errors.New(errCompact)
+	}
+	if err := tmp.Sync(); err != nil {
+		return errors.New(errCompact)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, err := io.Copy(tmp, io.NewSectionReader(store.f, size, store.size-size)); err != nil {
+		return errors.New(errCompact)
+	}
+	if err := tmp.Sync(); err != nil {
+		return errors.New(errCompact)
+	}
+	offset, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.New(errCompact)
+	}
+	if err := os.Rename(tmp.Name(), store.filename); err != nil {
+		return errors.New(errCompact)
+	}
+	ok = true
+
+	store.f.Close()
+	store.f = tmp
+	store.w.Reset(tmp)
+	store.records = len(snapshot) + store.records - records
+	store.size = offset
+	return nil
+}
+
+// Ping() checks that the log is still in place and that no write to it has failed (the
+// writer keeps the first error)
+
+func (store *URLStoreFile) Ping(ctx context.Context) error {
+	if err := store.ready(ctx); err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	open, err := store.f.Stat()
+	if err != nil {
+		return unavailable(errPing, err)
+	}
+	current, err := os.Stat(store.filename)
+	if err != nil {
+		return unavailable(errPing, err)
+	}
+	if !os.SameFile(open, current) {
+		return unavailable(errPing, errors.New(errMoved))
+	}
+	if err := store.w.Flush(); err != nil {
+		return unavailable(errPing, err)
+	}
+	return nil
 }
 
 func (store *URLStoreFile) Close() error {
+	store.URLStore.Close()
+	close(store.done)
+	store.wg.Wait()
 	err := store.f.Close()
 	if err != nil {
 		return errors.New(errClose)
 	}
 	return nil
 }
+
+// MigrateFile() upgrades the file store in the old format (string pairs with a short
+// URL and a full URL) to the current one. A half pair at the end of the old file (or
+// a pair without the final \n) is dropped. The new file is written aside and then
+// renamed over the old one. Missing, empty and already upgraded files are left as is.
+
+func MigrateFile(filename string) error {
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.New(errOpen)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if b, err := r.Peek(len(fileMagic)); len(b) == 0 || strings.HasPrefix(fileMagic, string(b)) {
+		if err != nil && err != io.EOF {
+			return errors.New(errRead)
+		}
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), ".migrate-*")
+	if err != nil {
+		return errors.New(errWrite)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return errors.New(errRead)
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		return errors.New(errWrite)
+	}
+	w := bufio.NewWriter(tmp)
+	if _, err := w.WriteString(fileHeader); err != nil {
+		return errors.New(errWrite)
+	}
+	for {
+		k, err1 := r.ReadString('\n')
+		v, err2 := r.ReadString('\n')
+		if err1 == io.EOF || err2 == io.EOF {
+			break
+		}
+		if err1 != nil || err2 != nil {
+			return errors.New(errRead)
+		}
+		line, err := encodeRecord(fileRecord{Short: strings.TrimSpace(k), URL: strings.TrimSpace(v)})
+		if err != nil {
+			return errors.New(errWrite)
+		}
+		if _, err := w.Write(line); err != nil {
+			return errors.New(errWrite)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return errors.New(errWrite)
+	}
+	if err := tmp.Sync(); err != nil {
+		return errors.New(errWrite)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.New(errWrite)
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return errors.New(errWrite)
+	}
+	return nil
+}
@@ -1,40 +1,559 @@
 package storage
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestAddGetFile(t *testing.T) {
-	store, _ := NewFile("./test.txt")
+// copyFile() copies the test file in the old format to a temporary directory, so the
+// tests do not upgrade the original one
+
+func copyFile(t *testing.T, filename string) string {
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	filename = filepath.Join(t.TempDir(), filepath.Base(filename))
+	require.NoError(t, os.WriteFile(filename, data, 0664))
+	return filename
+}
+
+func TestAddCollisionFile(t *testing.T) {
+	defer forceCollisions()()
+	store, err := NewFile(filepath.Join(t.TempDir(), "test.txt"), HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
 	defer store.Close()
-	var url string
-	var err error
+	testAddCollision(t, store)
+}
 
-	// Try to get without adding first
+func TestMigrateFile(t *testing.T) {
+	ctx := context.Background()
+	filename := copyFile(t, "./testdata/legacy.txt")
+	require.NoError(t, os.Chmod(filename, 0640))
+	require.NoError(t, MigrateFile(filename))
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), fileHeader))
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	// Migration of an upgraded file must change nothing
 	//
-	_, err = store.Get("0")
+	require.NoError(t, MigrateFile(filename))
+	again, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	assert.Equal(t, data, again)
+
+	store, err := NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	defer store.Close()
+	url, err := store.Get(ctx, "lFCg5Q==")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://www.google.com", url)
+	url, err = store.Get(ctx, "juZ_JA==")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://www.mail.ru", url)
+}
+
+func TestMigrateFileHalfPair(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	require.NoError(t, os.WriteFile(filename, []byte("lFCg5Q==\nhttp://www.google.com\nDK62VA==\n"), 0664))
+	store, err := NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	defer store.Close()
+	_, err = store.Get(ctx, "lFCg5Q==")
+	assert.NoError(t, err)
+	_, err = store.Get(ctx, "DK62VA==")
 	assert.Error(t, err)
+}
+
+func TestTornTailFile(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	store, err := NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	i1, _, err := store.Add(ctx, "http://www.google.com", "")
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+	size := fileSize(t, filename)
+
+	// Append a half of a record as if the store crashed while writing it
+	//
+	line, err := encodeRecord(fileRecord{Short: "DK62VA==", URL: "http://www.yandex.ru"})
+	require.NoError(t, err)
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0664)
+	require.NoError(t, err)
+	_, err = f.Write(line[:len(line)/2])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
 
-	// Try to add few, get one back and check
+	// Reopen the store and check the torn record has been truncated
 	//
-	i1, err := store.Add("http://www.google.com")
+	store, err = NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	assert.Equal(t, size, fileSize(t, filename))
+	url, err := store.Get(ctx, i1)
 	assert.NoError(t, err)
-	i2, err := store.Add("http://www.yandex.ru")
+	assert.Equal(t, "http://www.google.com", url)
+	_, err = store.Get(ctx, "DK62VA==")
+	assert.Error(t, err)
+	i2, _, err := store.Add(ctx, "http://www.yandex.ru", "")
+	assert.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	store, err = NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	defer store.Close()
+	url, err = store.Get(ctx, i2)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://www.yandex.ru", url)
+}
+
+func TestCorruptFile(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	store, err := NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	_, _, err = store.Add(ctx, "http://www.google.com", "")
+	require.NoError(t, err)
+	_, _, err = store.Add(ctx, "http://www.yandex.ru", "")
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	// Break a record in the middle of the file
+	//
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	data[len(fileHeader)+1] ^= 1
+	require.NoError(t, os.WriteFile(filename, data, 0664))
+	_, err = NewFile(filename, HashGenerator{}, CompactPolicy{})
+	assert.Error(t, err)
+
+	// Unknown format versions must not be opened
+	//
+	require.NoError(t, os.WriteFile(filename, []byte(fileMagic+"99\n"), 0664))
+	_, err = NewFile(filename, HashGenerator{}, CompactPolicy{})
+	assert.Error(t, err)
+}
+
+func fileSize(t *testing.T, filename string) int64 {
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	return info.Size()
+}
+
+// newBenchFile() makes a file store with n records to benchmark on
+
+func newBenchFile(b *testing.B, n int) *URLStoreFile {
+	filename := filepath.Join(b.TempDir(), "bench.txt")
+	f, err := os.Create(filename)
+	require.NoError(b, err)
+	w := bufio.NewWriter(f)
+	w.WriteString(fileHeader)
+	for i := 0; i < n; i++ {
+		line, err := encodeRecord(fileRecord{Short: strconv.Itoa(i), URL: fmt.Sprintf("http://www.google.com/%d", i)})
+		require.NoError(b, err)
+		w.Write(line)
+	}
+	require.NoError(b, w.Flush())
+	require.NoError(b, f.Close())
+	store, err := NewFile(filename, &CounterGenerator{}, CompactPolicy{})
+	require.NoError(b, err)
+	return store
+}
+
+func BenchmarkGetFile(b *testing.B) {
+	ctx := context.Background()
+	for _, n := range []int{1000, 1000000} {
+		b.Run(fmt.Sprintf("records=%d", n), func(b *testing.B) {
+			store := newBenchFile(b, n)
+			defer store.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := store.Get(ctx, strconv.Itoa(i%n)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAddFile(b *testing.B) {
+	ctx := context.Background()
+	for _, n := range []int{1000, 1000000} {
+		b.Run(fmt.Sprintf("records=%d", n), func(b *testing.B) {
+			store := newBenchFile(b, n)
+			defer store.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := store.Add(ctx, fmt.Sprintf("http://www.yandex.ru/%d", i), ""); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// newGarbageFile() makes a log with n records for the same short URL, so all of them
+// but the last one are garbage
+
+func newGarbageFile(t *testing.T, n int) string {
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	data := []byte(fileHeader)
+	for i := 0; i < n; i++ {
+		line, err := encodeRecord(fileRecord{Short: "abc", URL: fmt.Sprintf("http://www.google.com/%d", i)})
+		require.NoError(t, err)
+		data = append(data, line...)
+	}
+	require.NoError(t, os.WriteFile(filename, data, 0664))
+	return filename
+}
+
+func TestCompactFile(t *testing.T) {
+	ctx := context.Background()
+	filename := newGarbageFile(t, 100)
+	require.NoError(t, os.Chmod(filename, 0640))
+	store, err := NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	size := fileSize(t, filename)
+	require.NoError(t, store.Compact())
+	assert.Less(t, fileSize(t, filename), size)
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	// The store must keep working with the new log after compaction
+	//
+	url, err := store.Get(ctx, "abc")
 	assert.NoError(t, err)
-	i3, err := store.Add("http://www.mail.ru")
+	assert.Equal(t, "http://www.google.com/99", url)
+	id, _, err := store.Add(ctx, "http://www.yandex.ru", "")
 	assert.NoError(t, err)
-	url, err = store.Get(i1)
+	require.NoError(t, store.Close())
+
+	store, err = NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, 2, store.records)
+	url, err = store.Get(ctx, "abc")
 	assert.NoError(t, err)
-	assert.Equal(t, url, "http://www.google.com")
-	url, err = store.Get(i2)
+	assert.Equal(t, "http://www.google.com/99", url)
+	url, err = store.Get(ctx, id)
 	assert.NoError(t, err)
-	assert.Equal(t, url, "http://www.yandex.ru")
+	assert.Equal(t, "http://www.yandex.ru", url)
+}
 
-	// Try to add a duplicate and check
+func TestCompactFilePolicy(t *testing.T) {
+	ctx := context.Background()
+	// Too small garbage ratio must not trigger compaction
 	//
-	id, err := store.Add("http://www.mail.ru")
+	filename := newGarbageFile(t, 2)
+	store, err := NewFile(filename, HashGenerator{}, CompactPolicy{Interval: time.Millisecond, MinRatio: 0.9})
+	require.NoError(t, err)
+	size := fileSize(t, filename)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, size, fileSize(t, filename))
+	require.NoError(t, store.Close())
+
+	// Too small log must not trigger compaction
+	//
+	filename = newGarbageFile(t, 100)
+	store, err = NewFile(filename, HashGenerator{}, CompactPolicy{Interval: time.Millisecond, MinSize: 1 << 20, MinRatio: 0.5})
+	require.NoError(t, err)
+	size = fileSize(t, filename)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, size, fileSize(t, filename))
+	require.NoError(t, store.Close())
+
+	// Otherwise the log must be compacted in the background while the store is used
+	//
+	filename = newGarbageFile(t, 100)
+	store, err = NewFile(filename, HashGenerator{}, CompactPolicy{Interval: time.Millisecond, MinRatio: 0.3})
+	require.NoError(t, err)
+	defer store.Close()
+	for i := 0; i < 100; i++ {
+		_, _, err := store.Add(ctx, fmt.Sprintf("http://www.yandex.ru/%d", i), "")
+		require.NoError(t, err)
+		_, err = store.Get(ctx, "abc")
+		require.NoError(t, err)
+	}
+	assert.Eventually(t, func() bool {
+		data, err := os.ReadFile(filename)
+		require.NoError(t, err)
+		return bytes.Count(data, []byte("\n")) == 1+1+100
+	}, time.Second, time.Millisecond)
+}
+
+func TestTornBatchFile(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	store, err := NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	i1, _, err := store.Add(ctx, "http://www.google.com", "")
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	// Append a half of a batch as if the store crashed while writing it
+	//
+	line, err := encodeRecord(fileRecord{Batch: []fileRecord{
+		{Short: "DK62VA==", URL: "http://www.yandex.ru"},
+		{Short: "juZ_JA==", URL: "http://www.mail.ru"},
+	}})
+	require.NoError(t, err)
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0664)
+	require.NoError(t, err)
+	_, err = f.Write(line[:len(line)-len(line)/3])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// None of the batch records must survive
+	//
+	store, err = NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	defer store.Close()
+	_, err = store.Get(ctx, i1)
 	assert.NoError(t, err)
-	assert.Equal(t, id, i3)
+	_, err = store.Get(ctx, "DK62VA==")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = store.Get(ctx, "juZ_JA==")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestOwnerFile(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	store, err := NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	i1, _, err := store.Add(ctx, "http://www.google.com", "user1")
+	require.NoError(t, err)
+	ids, err := store.AddBatch(ctx, []string{"http://www.yandex.ru", "http://www.mail.ru"}, "user2")
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+	want := map[string]string{i1: "user1", ids[0]: "user2", ids[1]: "user2"}
+
+	// Owners must survive both reopen and compaction
+	//
+	store, err = NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	assert.Equal(t, want, owners(store.URLStore))
+	require.NoError(t, store.Compact())
+	require.NoError(t, store.Close())
+	store, err = NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, want, owners(store.URLStore))
+}
+
+func TestDeleteFile(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	store, err := NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	ids, err := store.AddBatch(ctx, []string{"http://www.google.com", "http://www.yandex.ru", "http://www.mail.ru"}, "user1")
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteBatch(ctx, ids[:2], "user1"))
+	_, _, err = store.Add(ctx, "http://www.google.com", "user2")
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	// Deleted and restored links must survive both reopen and compaction, and the
+	// deletion records are garbage after it
+	//
+	check := func(store *URLStoreFile) {
+		_, err := store.Get(ctx, ids[0])
+		assert.NoError(t, err)
+		_, err = store.Get(ctx, ids[1])
+		assert.ErrorIs(t, err, ErrDeleted)
+		assert.Equal(t, map[string]string{ids[0]: "user2", ids[1]: "user1", ids[2]: "user1"}, owners(store.URLStore))
+		assert.Equal(t, map[string][]string{"user1": ids[2:], "user2": ids[:1]}, store.byOwner)
+	}
+	store, err = NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	check(store)
+	assert.Equal(t, 6, store.records)
+	require.NoError(t, store.Compact())
+	assert.Equal(t, 3, store.records)
+	require.NoError(t, store.Close())
+	store, err = NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	defer store.Close()
+	check(store)
+}
+
+func TestPingFile(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	store, err := NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	require.NoError(t, store.Ping(ctx))
+
+	// The log removed from under the store is detected, and so is the closed one
+	//
+	require.NoError(t, os.Rename(filename, filename+".old"))
+	assert.ErrorIs(t, store.Ping(ctx), ErrUnavailable)
+	require.NoError(t, os.Rename(filename+".old", filename))
+	assert.NoError(t, store.Ping(ctx))
+	require.NoError(t, store.Close())
+	assert.ErrorIs(t, store.Ping(ctx), ErrUnavailable)
+}
+
+func TestAliasFile(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	store, err := NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	id, _, err := store.Add(ctx, "http://www.google.com", "user1")
+	require.NoError(t, err)
+	_, _, err = store.AddWithOptions(ctx, "http://www.google.com", "user1", AddOptions{Alias: "google"})
+	require.NoError(t, err)
+	_, _, err = store.AddWithOptions(ctx, "http://www.google.com", "", AddOptions{Alias: "search"})
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteBatch(ctx, []string{"google"}, "user1"))
+
+	// Aliases must survive compaction, and must not become the short URL of the full URL
+	//
+	require.NoError(t, store.Compact())
+	require.NoError(t, store.Close())
+	store, err = NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, map[string]bool{"google": true, "search": true}, aliases(store.URLStore))
+	assert.Equal(t, map[string]string{"http://www.google.com": id}, store.byURL)
+	_, _, err = store.AddWithOptions(ctx, "http://www.google.com", "user2", AddOptions{Alias: "google"})
+	require.NoError(t, err)
+}
+
+func TestExpiryFile(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	store, err := NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	limited, _, err := store.AddWithOptions(ctx, "http://www.google.com", "user1", AddOptions{MaxClicks: 3})
+	require.NoError(t, err)
+	_, _, err = store.AddWithOptions(ctx, "http://www.yandex.ru", "user1", AddOptions{ExpiresAt: time.Now().Add(-time.Second)})
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = store.Get(ctx, limited)
+		require.NoError(t, err)
+	}
+	n, err := store.PurgeExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// The clicks and the purged records are garbage after compaction, but the click count
+	// must survive it
+	//
+	assert.Equal(t, 5, store.records)
+	require.NoError(t, store.Compact())
+	assert.Equal(t, 1, store.records)
+	require.NoError(t, store.Close())
+	store, err = NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, map[string]string{limited: "user1"}, owners(store.URLStore))
+	_, err = store.Get(ctx, limited)
+	assert.NoError(t, err)
+	_, err = store.Get(ctx, limited)
+	assert.ErrorIs(t, err, ErrExpired)
+}
+
+func TestStatsFile(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	store, err := NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	short, _, err := store.Add(ctx, "http://www.google.com", "user1")
+	require.NoError(t, err)
+	day := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, store.AddClicks(ctx, []Click{{Short: short, Time: day, Referrer: "yandex.ru"}, {Short: short, Time: day}}))
+	}
+
+	// Each batch of clicks is a record, and compaction sums them up into a single one
+	//
+	assert.Equal(t, 4, store.records)
+	require.NoError(t, store.Compact())
+	assert.Equal(t, 2, store.records)
+	require.NoError(t, store.Close())
+	store, err = NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	defer store.Close()
+	stats, err := store.Stats(ctx, short, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, Stats{
+		Total:     6,
+		Days:      map[string]int64{"2023-03-01": 6},
+		Referrers: map[string]int64{"yandex.ru": 3, "": 3},
+	}, stats)
+}
+
+func TestUpdateFile(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	store, err := NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	i1, _, err := store.Add(ctx, "http://www.google.com", "user1")
+	require.NoError(t, err)
+	i2, _, err := store.Add(ctx, "http://www.yandex.ru", "user1")
+	require.NoError(t, err)
+	require.NoError(t, store.Update(ctx, i1, "http://www.bing.com", "user1"))
+	require.NoError(t, store.Update(ctx, i1, "http://www.mail.ru", "user1"))
+
+	// Edits carry the whole history, so only the last one survives compaction
+	//
+	assert.Equal(t, 4, store.records)
+	require.NoError(t, store.Compact())
+	assert.Equal(t, 2, store.records)
+	require.NoError(t, store.Close())
+	store, err = NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	defer store.Close()
+	links, err := store.ListByOwner(ctx, "user1", ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []Link{{Short: i1, URL: "http://www.mail.ru"}, {Short: i2, URL: "http://www.yandex.ru"}}, links)
+	revisions, err := store.History(ctx, i1, "user1")
+	require.NoError(t, err)
+	require.Len(t, revisions, 3)
+	assert.Equal(t, "http://www.google.com", revisions[0].URL)
+	assert.Equal(t, "http://www.bing.com", revisions[1].URL)
+	assert.Equal(t, map[string]bool{i1: true}, aliases(store.URLStore))
+}
+
+func TestKeysFile(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "test.txt")
+	store, err := NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	_, _, err = store.Add(ctx, "http://www.google.com", "user1")
+	require.NoError(t, err)
+	require.NoError(t, store.AddKey(ctx, APIKey{ID: "id1", Hash: "hash1", Owner: "user1", Scope: "create", CreatedAt: time.Now()}))
+	require.NoError(t, store.RevokeKey(ctx, "id1"))
+
+	// The revoked key replaces the former one, so only it survives compaction
+	//
+	assert.Equal(t, 3, store.records)
+	require.NoError(t, store.Compact())
+	assert.Equal(t, 2, store.records)
+	require.NoError(t, store.Close())
+	store, err = NewFile(filename, HashGenerator{}, CompactPolicy{})
+	require.NoError(t, err)
+	defer store.Close()
+	key, err := store.GetKey(ctx, "hash1")
+	require.NoError(t, err)
+	assert.True(t, key.Revoked)
+
+	// Key records are not garbage
+	//
+	assert.False(t, store.needsCompaction(CompactPolicy{MinRatio: 0.1}))
 }
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// IDGenerator makes short URLs for full URLs. If the short URL is already taken by
+// another full URL, a store calls Generate() again with the next attempt number, so
+// an implementation must not return the same short URL for all the attempts.
+
+type IDGenerator interface {
+	Generate(url string, attempt uint32) string
+}
+
+// seeder is an IDGenerator which has to know the short URLs already taken (aliases
+// aside), e.g. the counter one. Persistent stores seed it with them on open.
+
+type seeder interface {
+	Seed(short string)
+}
+
+const (
+	GeneratorHash    = "hash"
+	GeneratorCounter = "counter"
+	GeneratorRandom  = "random"
+)
+
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func NewIDGenerator(kind string, length int) (IDGenerator, error) {
+	switch kind {
+	case GeneratorHash:
+		return HashGenerator{}, nil
+	case GeneratorCounter:
+		return &CounterGenerator{}, nil
+	case GeneratorRandom:
+		if length <= 0 {
+			return nil, errors.New(errLength)
+		}
+		return RandomGenerator{Length: length}, nil
+	default:
+		return nil, fmt.Errorf("%s: %q", errGenerator, kind)
+	}
+}
+
+// Hash generator uses 32-bit FNV-1a hashes and Base64 encoding (see encode()). It
+// gives the same short URL for the same full URL in any store.
+
+type HashGenerator struct{}
+
+func (g HashGenerator) Generate(url string, attempt uint32) string {
+	return encode(url, attempt)
+}
+
+// Counter generator uses a monotonic counter and Base62 encoding. The counter is not
+// persisted, so a store seeds it with the short URLs it has, and the counter goes on
+// after the largest of them. The ones which are not Base62 numbers are ignored.
+
+type CounterGenerator struct {
+	n uint64
+}
+
+func (g *CounterGenerator) Generate(url string, attempt uint32) string {
+	n := atomic.AddUint64(&g.n, 1)
+	b := make([]byte, 0, 11)
+	for ; n > 0; n /= 62 {
+		b = append(b, base62[n%62])
+	}
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+func (g *CounterGenerator) Seed(short string) {
+	if short == "" || short[0] == base62[0] || len(short) > 10 {
+		return
+	}
+	var n uint64
+	for i := 0; i < len(short); i++ {
+		d := strings.IndexByte(base62, short[i])
+		if d < 0 {
+			return
+		}
+		n = n*62 + uint64(d)
+	}
+	for {
+		old := atomic.LoadUint64(&g.n)
+		if old >= n || atomic.CompareAndSwapUint64(&g.n, old, n) {
+			return
+		}
+	}
+}
+
+// Random generator uses cryptographically random Base62 strings of the given length.
+
+type RandomGenerator struct {
+	Length int
+}
+
+func (g RandomGenerator) Generate(url string, attempt uint32) string {
+	b := make([]byte, 0, g.Length)
+	r := make([]byte, g.Length)
+	for len(b) < g.Length {
+		if _, err := rand.Read(r); err != nil {
+			panic(err)
+		}
+		for _, c := range r {
+			// Skip the bytes above the largest multiple of 62 to keep the distribution
+			// uniform
+			if c < 248 && len(b) < g.Length {
+				b = append(b, base62[c%62])
+			}
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewIDGenerator(t *testing.T) {
+	g, err := NewIDGenerator(GeneratorHash, 0)
+	require.NoError(t, err)
+	assert.IsType(t, HashGenerator{}, g)
+	g, err = NewIDGenerator(GeneratorCounter, 0)
+	require.NoError(t, err)
+	assert.IsType(t, &CounterGenerator{}, g)
+	g, err = NewIDGenerator(GeneratorRandom, 10)
+	require.NoError(t, err)
+	assert.Equal(t, RandomGenerator{Length: 10}, g)
+
+	_, err = NewIDGenerator(GeneratorRandom, 0)
+	assert.Error(t, err)
+	_, err = NewIDGenerator("unknown", 8)
+	assert.Error(t, err)
+}
+
+func TestCounterGenerator(t *testing.T) {
+	g := &CounterGenerator{}
+	assert.Equal(t, "1", g.Generate("http://www.google.com", 0))
+	assert.Equal(t, "2", g.Generate("http://www.google.com", 1))
+	for i := 3; i < 61; i++ {
+		g.Generate("http://www.google.com", 0)
+	}
+	assert.Equal(t, "z", g.Generate("http://www.google.com", 0))
+	assert.Equal(t, "10", g.Generate("http://www.google.com", 0))
+
+	// Seeding moves the counter forward only, and skips what it could not give
+	//
+	g = &CounterGenerator{}
+	for _, short := range []string{"10", "z", "0A", "1-", "zzzzzzzzzzz", ""} {
+		g.Seed(short)
+	}
+	assert.Equal(t, "11", g.Generate("http://www.google.com", 0))
+}
+
+func TestRandomGenerator(t *testing.T) {
+	g := RandomGenerator{Length: 12}
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		short := g.Generate("http://www.google.com", 0)
+		assert.Len(t, short, 12)
+		assert.Empty(t, strings.Trim(short, base62))
+		assert.False(t, seen[short])
+		seen[short] = true
+	}
+}
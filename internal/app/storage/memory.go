@@ -1,39 +1,597 @@
 package storage
 
 import (
-	"errors"
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Memory store impelementation. It uses a built-in map data type:
-// - key is a short URL
-// - value is the corresponding full URL
+// Memory store impelementation. It uses built-in maps (see URLStore): the records of
+// the links by short URLs, and the indexes of them by full URLs (generated short URLs
+// only) and by owners. The maps are guarded by a read-write mutex, so redirects do not
+// contend with each other (except the ones of links with limited clicks, which are
+// counted under the write lock). Deleted and expired links stay in the maps (so their
+// short URLs are never reused) until expired ones are purged. The statistics keep only
+// the counts of redirects, not the clicks themselves. API keys are kept by their IDs
+// apart from the links, along with the index of them by hashes.
+//
+// Other stores may use the memory store as an index and set persist() to save records.
+// A record with the full URL replaces the one with the same short URL (that is how
+// links are added, deleted and restored), and a record without it only updates the
+// existing one: sets the clicks, adds up the statistics, or removes it if purged. A
+// restored link is a new one, so it drops the statistics and the history of the former
+// one. A record with the history of the existing link is an edit of it, which keeps its
+// place in the index by owners. The history slices are never changed in place, so they
+// are shared by the records. A record with the API key (and nothing else) replaces the
+// key with the same ID.
+
+type record struct {
+	short     string
+	url       string
+	owner     string
+	alias     bool
+	deleted   bool
+	purged    bool
+	expiresAt time.Time
+	maxClicks int64
+	clicks    int64
+	stats     *Stats
+	history   []Revision
+	key       *APIKey
+}
+
+func (r record) expired(now time.Time) bool {
+	return expired(now, r.expiresAt, r.maxClicks, r.clicks)
+}
 
 type URLStore struct {
-	s map[string]string
+	mu       sync.RWMutex
+	links    map[string]record     // records of the links by short URLs
+	byURL    map[string]string     // generated short URLs by full URLs
+	byOwner  map[string][]string   // short URLs by owners, in the order they were added
+	stats    map[string]*Stats     // statistics of redirects by short URLs
+	history  map[string][]Revision // former full URLs of the edited short URLs
+	keys     map[string]APIKey     // API keys by IDs
+	keyIDs   map[string]string     // IDs of the API keys by hashes
+	g        IDGenerator
+	reserved map[string]bool // short URLs which must not be generated (see Reserver)
+	closed   atomic.Bool
+	persist  func(recs []record) error
 }
 
-func NewMemory() (*URLStore, error) {
+func NewMemory(g IDGenerator) (*URLStore, error) {
 	return &URLStore{
-		s: map[string]string{},
+		links:   map[string]record{},
+		byURL:   map[string]string{},
+		byOwner: map[string][]string{},
+		stats:   map[string]*Stats{},
+		history: map[string][]Revision{},
+		keys:    map[string]APIKey{},
+		keyIDs:  map[string]string{},
+		g:       g,
 	}, nil
 }
 
-func (store *URLStore) Add(url string) (string, error) {
-	short := encode(url)
-	if _,ok := store.s[short]; !ok {
-		store.s[short] = url
+// seed() seeds the generator with the short URLs, the stores loading the records call
+// it once they are loaded
+
+func (store *URLStore) seed() {
+	g, ok := store.g.(seeder)
+	if !ok {
+		return
+	}
+	for short, r := range store.links {
+		if !r.alias {
+			g.Seed(short)
+		}
+	}
+}
+
+// insert() puts a record into the maps, it must be called under the write lock
+
+func (store *URLStore) insert(r record) {
+	if r.key != nil {
+		store.keys[r.key.ID] = *r.key
+		store.keyIDs[r.key.Hash] = r.key.ID
+		return
+	}
+	old, ok := store.links[r.short]
+	if r.url == "" {
+		switch {
+		case !ok:
+		case r.purged:
+			store.unlist(old)
+			delete(store.links, r.short)
+			if store.byURL[old.url] == r.short {
+				delete(store.byURL, old.url)
+			}
+			delete(store.stats, r.short)
+			delete(store.history, r.short)
+		case r.stats != nil:
+			if store.stats[r.short] == nil {
+				store.stats[r.short] = newStats()
+			}
+			store.stats[r.short].merge(r.stats)
+		default:
+			old.clicks = r.clicks
+			store.links[r.short] = old
+		}
+		return
+	}
+	if ok && old.url != r.url && store.byURL[old.url] == r.short {
+		delete(store.byURL, old.url)
+	}
+	edit := ok && r.history != nil
+	if ok && !edit && !r.deleted {
+		delete(store.stats, r.short)
+		delete(store.history, r.short)
+	}
+	if r.history != nil {
+		store.history[r.short] = r.history
+		r.history = nil
+	}
+	if ok && !edit {
+		store.unlist(old)
+	}
+	store.links[r.short] = r
+	if _, ok := store.byURL[r.url]; !ok && !r.alias {
+		store.byURL[r.url] = r.short
+	}
+	if r.owner != "" && !r.deleted && !edit {
+		store.byOwner[r.owner] = append(store.byOwner[r.owner], r.short)
+	}
+}
+
+// unlist() removes the record from the index by owners
+
+func (store *URLStore) unlist(r record) {
+	if r.owner == "" || r.deleted {
+		return
+	}
+	shorts := store.byOwner[r.owner]
+	for i := range shorts {
+		if shorts[i] == r.short {
+			store.byOwner[r.owner] = append(shorts[:i:i], shorts[i+1:]...)
+			break
+		}
+	}
+}
+
+// save() persists the records first, and puts them into the maps only if it succeeds
+
+func (store *URLStore) save(recs []record) error {
+	if store.persist != nil && len(recs) > 0 {
+		if err := store.persist(recs); err != nil {
+			return err
+		}
+	}
+	for _, r := range recs {
+		store.insert(r)
+	}
+	return nil
+}
+
+func (store *URLStore) Add(ctx context.Context, url, owner string) (string, bool, error) {
+	return store.AddWithOptions(ctx, url, owner, AddOptions{})
+}
+
+func (store *URLStore) AddWithOptions(ctx context.Context, url, owner string, opts AddOptions) (string, bool, error) {
+	if err := store.ready(ctx); err != nil {
+		return "", false, err
+	}
+	if opts.Alias != "" {
+		if err := store.addAlias(url, owner, opts); err != nil {
+			return "", false, err
+		}
+		return opts.Alias, true, nil
+	}
+	store.mu.RLock()
+	short, ok := store.byURL[url]
+	ok = ok && !store.links[short].deleted && !store.links[short].expired(time.Now())
+	store.mu.RUnlock()
+	if ok {
+		return short, false, nil
+	}
+
+	// Check again under the write lock as the URL could have been added meanwhile
+	//
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	shorts, added, err := store.add([]string{url}, owner, opts)
+	if err != nil {
+		return "", false, err
+	}
+	return shorts[0], added == 1, nil
+}
+
+// AddBatch() adds all the URLs at once: either all of them are added, or none
+
+func (store *URLStore) AddBatch(ctx context.Context, urls []string, owner string) ([]string, error) {
+	if err := store.ready(ctx); err != nil {
+		return nil, err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	shorts, _, err := store.add(urls, owner, AddOptions{})
+	return shorts, err
+}
+
+// add() must be called under the write lock. New records are collected aside first,
+// and the maps are updated only after all of them have been persisted. It returns the
+// short URLs and the number of the new ones.
+
+func (store *URLStore) add(urls []string, owner string, opts AddOptions) ([]string, int, error) {
+	shorts := make([]string, len(urls))
+	s, u := map[string]string{}, map[string]string{}
+	var recs []record
+	now := time.Now()
+next:
+	for i, url := range urls {
+		if short, ok := u[url]; ok {
+			shorts[i] = short
+			continue
+		}
+		if short, ok := store.byURL[url]; ok {
+			if r := store.links[short]; r.deleted || r.expired(now) {
+				// Restore the deleted (or expired) short URL for the new owner
+				//
+				u[url] = short
+				recs = append(recs, newRecord(short, url, owner, opts))
+			}
+			shorts[i] = short
+			continue
+		}
+		for attempt := uint32(0); attempt < maxAttempts; attempt++ {
+			short := store.g.Generate(url, attempt)
+			if store.reserved[strings.ToLower(short)] {
+				continue
+			}
+			_, ok1 := store.links[short]
+			_, ok2 := s[short]
+			if !ok1 && !ok2 {
+				s[short] = url
+				u[url] = short
+				recs = append(recs, newRecord(short, url, owner, opts))
+				shorts[i] = short
+				continue next
+			}
+		}
+		return nil, 0, conflict(errNoShort)
+	}
+
+	if err := store.save(recs); err != nil {
+		return nil, 0, err
+	}
+	return shorts, len(recs), nil
+}
+
+func newRecord(short, url, owner string, opts AddOptions) record {
+	return record{
+		short:     short,
+		url:       url,
+		owner:     owner,
+		alias:     opts.Alias != "",
+		expiresAt: opts.ExpiresAt,
+		maxClicks: opts.MaxClicks,
+	}
+}
+
+// addAlias() takes the alias even if it is a short URL yet to be generated, as the
+// generators skip the taken ones
+
+func (store *URLStore) addAlias(url, owner string, opts AddOptions) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if r, ok := store.links[opts.Alias]; ok && (r.url != url || !r.alias || !r.deleted && !r.expired(time.Now())) {
+		return conflict(errAlias)
+	}
+	return store.save([]record{newRecord(opts.Alias, url, owner, opts)})
+}
+
+func (store *URLStore) Get(ctx context.Context, short string) (string, error) {
+	if err := store.ready(ctx); err != nil {
+		return "", err
+	}
+	store.mu.RLock()
+	r, ok := store.links[short]
+	store.mu.RUnlock()
+	if !ok {
+		return "", ErrNotFound
+	}
+	if r.deleted {
+		return "", ErrDeleted
+	}
+	if r.expired(time.Now()) {
+		return "", ErrExpired
+	}
+	if r.maxClicks == 0 {
+		return r.url, nil
+	}
+	return store.click(short)
+}
+
+func (store *URLStore) Lookup(ctx context.Context, short string) (string, error) {
+	if err := store.ready(ctx); err != nil {
+		return "", err
+	}
+	store.mu.RLock()
+	r, ok := store.links[short]
+	store.mu.RUnlock()
+	switch {
+	case !ok:
+		return "", ErrNotFound
+	case r.deleted:
+		return "", ErrDeleted
+	case r.expired(time.Now()):
+		return "", ErrExpired
+	}
+	return r.url, nil
+}
+
+// click() counts the redirect of a link with limited clicks. The link is checked again
+// under the write lock as it could have been changed meanwhile.
+
+func (store *URLStore) click(short string) (string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	r, ok := store.links[short]
+	switch {
+	case !ok:
+		return "", ErrNotFound
+	case r.deleted:
+		return "", ErrDeleted
+	case r.expired(time.Now()):
+		return "", ErrExpired
+	}
+	if err := store.save([]record{{short: short, clicks: r.clicks + 1}}); err != nil {
+		return "", err
+	}
+	return r.url, nil
+}
+
+func (store *URLStore) ListByOwner(ctx context.Context, owner string, opts ListOptions) ([]Link, error) {
+	if err := store.ready(ctx); err != nil {
+		return nil, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	store.mu.RLock()
+	shorts := store.byOwner[owner]
+	links := make([]Link, len(shorts))
+	for i, short := range shorts {
+		links[i] = Link{Short: short, URL: store.links[short].url}
+	}
+	store.mu.RUnlock()
+	return opts.page(links), nil
+}
+
+func (store *URLStore) DeleteBatch(ctx context.Context, shorts []string, owner string) error {
+	if err := store.ready(ctx); err != nil {
+		return err
+	}
+	if owner == "" {
+		return nil
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	seen := map[string]bool{}
+	var recs []record
+	for _, short := range shorts {
+		r, ok := store.links[short]
+		if !ok || r.owner != owner || r.deleted || seen[short] {
+			continue
+		}
+		seen[short] = true
+		r.deleted = true
+		recs = append(recs, r)
+	}
+	return store.save(recs)
+}
+
+// PurgeExpired() removes the expired links, so their short URLs become free
+
+func (store *URLStore) PurgeExpired(ctx context.Context) (int, error) {
+	if err := store.ready(ctx); err != nil {
+		return 0, err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := time.Now()
+	var recs []record
+	for short, r := range store.links {
+		if r.expired(now) {
+			recs = append(recs, record{short: short, purged: true})
+		}
+	}
+	if err := store.save(recs); err != nil {
+		return 0, err
+	}
+	return len(recs), nil
+}
+
+// AddClicks() sums the clicks up by short URLs, so there is a single record for each
+// of them
+
+func (store *URLStore) AddClicks(ctx context.Context, clicks []Click) error {
+	if err := store.ready(ctx); err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	stats := map[string]*Stats{}
+	var recs []record
+	for _, c := range clicks {
+		if _, ok := store.links[c.Short]; !ok {
+			continue
+		}
+		if stats[c.Short] == nil {
+			stats[c.Short] = newStats()
+			recs = append(recs, record{short: c.Short, stats: stats[c.Short]})
+		}
+		stats[c.Short].add(c)
+	}
+	return store.save(recs)
+}
+
+func (store *URLStore) Stats(ctx context.Context, short, owner string) (Stats, error) {
+	if err := store.ready(ctx); err != nil {
+		return Stats{}, err
+	}
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if _, err := store.owned(short, owner); err != nil {
+		return Stats{}, err
+	}
+	stats := newStats()
+	if s, ok := store.stats[short]; ok {
+		stats.merge(s)
+	}
+	return *stats, nil
+}
+
+func (store *URLStore) Update(ctx context.Context, short, url, owner string) error {
+	if err := store.ready(ctx); err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	r, err := store.owned(short, owner)
+	if err != nil {
+		return err
+	}
+	switch {
+	case r.deleted:
+		return ErrDeleted
+	case r.expired(time.Now()):
+		return ErrExpired
+	case r.url == url:
+		return nil
+	}
+	history := store.history[short]
+	r.history = append(history[:len(history):len(history)], Revision{
+		Version:    int64(len(history) + 1),
+		URL:        r.url,
+		ReplacedAt: time.Now(),
+	})
+	r.url = url
+	r.alias = true
+	return store.save([]record{r})
+}
+
+func (store *URLStore) History(ctx context.Context, short, owner string) ([]Revision, error) {
+	if err := store.ready(ctx); err != nil {
+		return nil, err
+	}
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	r, err := store.owned(short, owner)
+	if err != nil {
+		return nil, err
 	}
-	return short, nil
+	history := store.history[short]
+	revisions := make([]Revision, len(history), len(history)+1)
+	copy(revisions, history)
+	return append(revisions, Revision{Version: int64(len(history) + 1), URL: r.url}), nil
 }
 
-func (store *URLStore) Get(short string) (string, error) {
-	url, ok := store.s[short]
+// owned() gives the record of the owner's short URL, it must be called under a lock
+
+func (store *URLStore) owned(short, owner string) (record, error) {
+	r, ok := store.links[short]
 	if !ok {
-		return "", errors.New(errNoURL)
+		return r, ErrNotFound
+	}
+	if owner == "" || r.owner != owner {
+		return r, ErrForbidden
+	}
+	return r, nil
+}
+
+func (store *URLStore) AddKey(ctx context.Context, key APIKey) error {
+	if err := store.ready(ctx); err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	_, ok1 := store.keys[key.ID]
+	_, ok2 := store.keyIDs[key.Hash]
+	if ok1 || ok2 {
+		return conflict(errKey)
+	}
+	return store.save([]record{{key: &key}})
+}
+
+func (store *URLStore) GetKey(ctx context.Context, hash string) (APIKey, error) {
+	if err := store.ready(ctx); err != nil {
+		return APIKey{}, err
+	}
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	id, ok := store.keyIDs[hash]
+	if !ok {
+		return APIKey{}, ErrNotFound
+	}
+	return store.keys[id], nil
+}
+
+func (store *URLStore) ListKeys(ctx context.Context) ([]APIKey, error) {
+	if err := store.ready(ctx); err != nil {
+		return nil, err
+	}
+	store.mu.RLock()
+	keys := make([]APIKey, 0, len(store.keys))
+	for _, key := range store.keys {
+		keys = append(keys, key)
 	}
-	return url, nil
+	store.mu.RUnlock()
+	sortKeys(keys)
+	return keys, nil
+}
+
+func (store *URLStore) RevokeKey(ctx context.Context, id string) error {
+	if err := store.ready(ctx); err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	key, ok := store.keys[id]
+	switch {
+	case !ok:
+		return ErrNotFound
+	case key.Revoked:
+		return nil
+	}
+	key.Revoked = true
+	return store.save([]record{{key: &key}})
+}
+
+func (store *URLStore) Reserve(names map[string]bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.reserved = names
+}
+
+// ready() returns the error of the context if it is done, or ErrUnavailable if the
+// store has been closed
+
+func (store *URLStore) ready(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if store.closed.Load() {
+		return unavailable(errClosed, nil)
+	}
+	return nil
+}
+
+func (store *URLStore) Ping(ctx context.Context) error {
+	return store.ready(ctx)
 }
 
 func (store *URLStore) Close() error {
+	store.closed.Store(true)
 	return nil
 }
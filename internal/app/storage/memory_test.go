@@ -1,40 +1,76 @@
 package storage
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestAddGet(t *testing.T) {
-	store, _ := NewMemory()
+func TestAddCollision(t *testing.T) {
+	defer forceCollisions()()
+	store, _ := NewMemory(HashGenerator{})
 	defer store.Close()
-	var url string
-	var err error
+	testAddCollision(t, store)
+}
+
+func TestReserve(t *testing.T) {
+	store, _ := NewMemory(listGenerator{"Ping", "api", "abc"})
+	defer store.Close()
+	testReserve(t, store)
+}
+
+// constGenerator gives the same short URL for all full URLs and attempts
+
+type constGenerator struct{}
 
-	// Try to get without adding first
+func (g constGenerator) Generate(url string, attempt uint32) string {
+	return "abc"
+}
+
+func TestAddNoShort(t *testing.T) {
+	ctx := context.Background()
+	store, _ := NewMemory(constGenerator{})
+	defer store.Close()
+	id, _, err := store.Add(ctx, "http://www.google.com", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", id)
+
+	// Try to add another one when no short URL is free
 	//
-	_, err = store.Get("0")
-	assert.Error(t, err)
+	_, _, err = store.Add(ctx, "http://www.yandex.ru", "")
+	assert.ErrorIs(t, err, ErrConflict)
+}
 
-	// Try to add few, get one back and check
+func TestAddBatchNoShort(t *testing.T) {
+	ctx := context.Background()
+	store, _ := NewMemory(constGenerator{})
+	defer store.Close()
+
+	// The batch must be added either as a whole, or not at all
 	//
-	i1, err := store.Add("http://www.google.com")
-	assert.NoError(t, err)
-	i2, err := store.Add("http://www.yandex.ru")
-	assert.NoError(t, err)
-	i3, err := store.Add("http://www.mail.ru")
-	assert.NoError(t, err)
-	url, err = store.Get(i1)
-	assert.NoError(t, err)
-	assert.Equal(t, url, "http://www.google.com")
-	url, err = store.Get(i2)
-	assert.NoError(t, err)
-	assert.Equal(t, url, "http://www.yandex.ru")
+	_, err := store.AddBatch(ctx, []string{"http://www.google.com", "http://www.yandex.ru"}, "")
+	assert.ErrorIs(t, err, ErrConflict)
+	_, err = store.Get(ctx, "abc")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestAddOwner(t *testing.T) {
+	ctx := context.Background()
+	store, _ := NewMemory(HashGenerator{})
+	defer store.Close()
+
+	i1, _, err := store.Add(ctx, "http://www.google.com", "user1")
+	require.NoError(t, err)
+	ids, err := store.AddBatch(ctx, []string{"http://www.yandex.ru", "http://www.google.com"}, "user2")
+	require.NoError(t, err)
+	i3, _, err := store.Add(ctx, "http://www.mail.ru", "")
+	require.NoError(t, err)
 
-	// Try to add a duplicate and check
+	// Owners of the existing short URLs must stay the same
 	//
-	id, err := store.Add("http://www.mail.ru")
-	assert.NoError(t, err)
-	assert.Equal(t, id, i3)
+	assert.Equal(t, map[string]string{i1: "user1", ids[0]: "user2"}, owners(store))
+	assert.Equal(t, i1, ids[1])
+	assert.NotContains(t, owners(store), i3)
 }
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// PostgreSQL store implementation. It uses the pgx driver through database/sql, which
+// keeps a pool of connections shared by all requests.
+
+const (
+	postgresMaxOpenConns    = 20
+	postgresMaxIdleConns    = 5
+	postgresConnMaxIdleTime = 5 * time.Minute
+	postgresConnMaxLifetime = time.Hour
+)
+
+var postgresQueries = sqlQueries{
+	lock:     `SELECT pg_advisory_xact_lock(hashtext('schema_versions'))`,
+	versions: `CREATE TABLE IF NOT EXISTS schema_versions (version INTEGER PRIMARY KEY)`,
+	migrations: [][]string{
+		{
+			`CREATE TABLE urls (
+				short_url    TEXT NOT NULL,
+				original_url TEXT NOT NULL
+			)`,
+			`CREATE UNIQUE INDEX urls_short_url ON urls (short_url)`,
+			`CREATE UNIQUE INDEX urls_original_url ON urls (original_url)`,
+		},
+		{
+			`ALTER TABLE urls ADD COLUMN owner TEXT NOT NULL DEFAULT ''`,
+		},
+		{
+			`ALTER TABLE urls ADD COLUMN id BIGSERIAL`,
+			`CREATE INDEX urls_owner ON urls (owner, id)`,
+		},
+		{
+			`ALTER TABLE urls ADD COLUMN is_deleted BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+		{
+			// A full URL may have several aliases, but only one generated short URL
+			`ALTER TABLE urls ADD COLUMN is_alias BOOLEAN NOT NULL DEFAULT FALSE`,
+			`DROP INDEX urls_original_url`,
+			`CREATE UNIQUE INDEX urls_original_url ON urls (original_url) WHERE NOT is_alias`,
+		},
+		{
+			`ALTER TABLE urls ADD COLUMN expires_at BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE urls ADD COLUMN max_clicks BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE urls ADD COLUMN clicks BIGINT NOT NULL DEFAULT 0`,
+		},
+		{
+			`CREATE TABLE click_events (
+				short_url  TEXT NOT NULL,
+				clicked_at BIGINT NOT NULL,
+				referrer   TEXT NOT NULL,
+				user_agent TEXT NOT NULL,
+				ip_hash    TEXT NOT NULL
+			)`,
+			`CREATE INDEX click_events_short_url ON click_events (short_url)`,
+		},
+		{
+			`CREATE TABLE url_history (
+				short_url    TEXT NOT NULL,
+				version      BIGINT NOT NULL,
+				original_url TEXT NOT NULL,
+				replaced_at  BIGINT NOT NULL
+			)`,
+			`CREATE UNIQUE INDEX url_history_short_url ON url_history (short_url, version)`,
+		},
+		{
+			`CREATE TABLE api_keys (
+				id         TEXT NOT NULL,
+				key_hash   TEXT NOT NULL,
+				owner      TEXT NOT NULL,
+				scope      TEXT NOT NULL,
+				created_at BIGINT NOT NULL,
+				is_revoked BOOLEAN NOT NULL DEFAULT FALSE
+			)`,
+			`CREATE UNIQUE INDEX api_keys_id ON api_keys (id)`,
+			`CREATE UNIQUE INDEX api_keys_key_hash ON api_keys (key_hash)`,
+		},
+	},
+	add:      `INSERT INTO urls (short_url, original_url, owner, expires_at, max_clicks) VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING`,
+	getShort: `SELECT short_url, is_deleted, expires_at, max_clicks, clicks FROM urls WHERE original_url = $1 AND NOT is_alias`,
+	getURL:   `SELECT original_url, is_deleted, expires_at, max_clicks, clicks FROM urls WHERE short_url = $1`,
+	getLink:  `SELECT original_url, owner, is_deleted, expires_at, max_clicks, clicks FROM urls WHERE short_url = $1`,
+	restore: `UPDATE urls SET owner = $1, expires_at = $2, max_clicks = $3, clicks = 0, is_deleted = FALSE, id = DEFAULT
+		WHERE short_url = $4 AND original_url = $5 AND is_alias = $6
+		AND (is_deleted OR expires_at > 0 AND expires_at <= $7 OR max_clicks > 0 AND clicks >= max_clicks)`,
+	addAlias: `INSERT INTO urls (short_url, original_url, owner, expires_at, max_clicks, is_alias) VALUES ($1, $2, $3, $4, $5, TRUE) ON CONFLICT DO NOTHING`,
+	click:    `UPDATE urls SET clicks = clicks + 1 WHERE short_url = $1 AND NOT is_deleted AND (expires_at = 0 OR expires_at > $2) AND clicks < max_clicks`,
+	delete:   `UPDATE urls SET is_deleted = TRUE WHERE short_url = $1 AND owner = $2`,
+	purge:    `DELETE FROM urls WHERE expires_at > 0 AND expires_at <= $1 OR max_clicks > 0 AND clicks >= max_clicks`,
+	purgeClicks: `DELETE FROM click_events WHERE short_url IN
+		(SELECT short_url FROM urls WHERE expires_at > 0 AND expires_at <= $1 OR max_clicks > 0 AND clicks >= max_clicks)`,
+	clearClicks: `DELETE FROM click_events WHERE short_url = $1`,
+	addClick: `INSERT INTO click_events (short_url, clicked_at, referrer, user_agent, ip_hash)
+		SELECT $1::TEXT, $2::BIGINT, $3::TEXT, $4::TEXT, $5::TEXT WHERE EXISTS (SELECT 1 FROM urls WHERE short_url = $6)`,
+	statsDays: `SELECT to_char(to_timestamp(clicked_at / 1000) AT TIME ZONE 'UTC', 'YYYY-MM-DD'), COUNT(*) FROM click_events WHERE short_url = $1 GROUP BY 1`,
+	statsRefs: `SELECT referrer, COUNT(*) FROM click_events WHERE short_url = $1 GROUP BY referrer`,
+	update:    `UPDATE urls SET original_url = $1, is_alias = TRUE WHERE short_url = $2 AND original_url = $3 AND owner = $4 AND NOT is_deleted`,
+	addRevision: `INSERT INTO url_history (short_url, version, original_url, replaced_at)
+		SELECT $1::TEXT, COALESCE(MAX(version), 0) + 1, $2::TEXT, $3::BIGINT FROM url_history WHERE short_url = $4`,
+	history: `SELECT version, original_url, replaced_at FROM url_history WHERE short_url = $1 ORDER BY version`,
+	purgeHistory: `DELETE FROM url_history WHERE short_url IN
+		(SELECT short_url FROM urls WHERE expires_at > 0 AND expires_at <= $1 OR max_clicks > 0 AND clicks >= max_clicks)`,
+	clearHistory: `DELETE FROM url_history WHERE short_url = $1`,
+	addKey:       `INSERT INTO api_keys (id, key_hash, owner, scope, created_at) VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING`,
+	getKey:       `SELECT id, owner, scope, created_at, is_revoked FROM api_keys WHERE key_hash = $1`,
+	listKeys:     `SELECT id, key_hash, owner, scope, created_at, is_revoked FROM api_keys ORDER BY created_at, id`,
+	revokeKey:    `UPDATE api_keys SET is_revoked = TRUE WHERE id = $1`,
+	list:         `SELECT short_url, original_url FROM urls WHERE owner = $1 AND NOT is_deleted`,
+	shorts:       `SELECT short_url FROM urls WHERE NOT is_alias`,
+	columns: map[string]string{
+		// Sort by bytes as the other stores do, not by the database locale
+		SortCreated: "id",
+		SortShort:   `short_url COLLATE "C"`,
+		SortURL:     `original_url COLLATE "C"`,
+	},
+	noLimit:    "ALL",
+	version:    `SELECT COALESCE(MAX(version), 0) FROM schema_versions`,
+	setVersion: `INSERT INTO schema_versions (version) VALUES ($1)`,
+}
+
+func NewPostgres(dsn string, g IDGenerator) (*URLStoreSQL, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", errOpen, err)
+	}
+	db.SetMaxOpenConns(postgresMaxOpenConns)
+	db.SetMaxIdleConns(postgresMaxIdleConns)
+	db.SetConnMaxIdleTime(postgresConnMaxIdleTime)
+	db.SetConnMaxLifetime(postgresConnMaxLifetime)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", errOpen, err)
+	}
+	return newSQL(db, postgresQueries, g)
+}
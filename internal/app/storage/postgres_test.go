@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPostgresDSN() gives a DSN of an empty PostgreSQL database. It uses the database
+// from TEST_DATABASE_DSN if set, or else spawns a local PostgreSQL instance in a
+// temporary directory. The test is skipped if neither is possible. CI sets
+// TEST_DATABASE_DSN to the database of a service container.
+
+func newPostgresDSN(t *testing.T) string {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		dsn = spawnPostgres(t)
+	}
+	db, err := sql.Open("pgx", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec("DROP TABLE IF EXISTS urls, click_events, url_history, api_keys, schema_versions")
+	require.NoError(t, err)
+	return dsn
+}
+
+// postgresBinDirs are where the distributions install the server binaries, which are
+// often not in PATH (e.g. /usr/lib/postgresql/15/bin on Debian and Ubuntu)
+
+var postgresBinDirs = []string{
+	"/usr/lib/postgresql/*/bin",
+	"/usr/pgsql-*/bin",
+	"/usr/local/opt/postgresql*/bin",
+	"/opt/homebrew/opt/postgresql*/bin",
+}
+
+// lookPostgres() finds the PostgreSQL binary in PATH or in postgresBinDirs (of any
+// version)
+
+func lookPostgres(name string) (string, error) {
+	if path, err := exec.LookPath(name); err == nil {
+		return path, nil
+	}
+	for _, pattern := range postgresBinDirs {
+		dirs, _ := filepath.Glob(pattern)
+		for _, dir := range dirs {
+			if path, err := exec.LookPath(filepath.Join(dir, name)); err == nil {
+				return path, nil
+			}
+		}
+	}
+	return "", exec.ErrNotFound
+}
+
+func spawnPostgres(t *testing.T) string {
+	initdb, err1 := lookPostgres("initdb")
+	pgctl, err2 := lookPostgres("pg_ctl")
+	if err1 != nil || err2 != nil {
+		t.Skip("PostgreSQL is not installed, set TEST_DATABASE_DSN to the DSN of an empty database to run the test")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("PostgreSQL does not run as root, set TEST_DATABASE_DSN to the DSN of an empty database to run the test")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	out, err := exec.Command(initdb, "-D", data, "-U", "postgres", "--auth=trust").CombinedOutput()
+	require.NoError(t, err, string(out))
+	opts := fmt.Sprintf("-p %d -k %s -c listen_addresses=127.0.0.1", port, dir)
+	out, err = exec.Command(pgctl, "-D", data, "-o", opts, "-w", "start").CombinedOutput()
+	require.NoError(t, err, string(out))
+	t.Cleanup(func() {
+		exec.Command(pgctl, "-D", data, "-m", "immediate", "stop").Run()
+	})
+	return fmt.Sprintf("host=127.0.0.1 port=%d user=postgres dbname=postgres sslmode=disable", port)
+}
+
+func TestAddCollisionPostgres(t *testing.T) {
+	defer forceCollisions()()
+	store, err := NewPostgres(newPostgresDSN(t), HashGenerator{})
+	require.NoError(t, err)
+	defer store.Close()
+	testAddCollision(t, store)
+}
+
+func TestReservePostgres(t *testing.T) {
+	store, err := NewPostgres(newPostgresDSN(t), listGenerator{"Ping", "api", "abc"})
+	require.NoError(t, err)
+	defer store.Close()
+	testReserve(t, store)
+}
+
+func TestMigratePostgres(t *testing.T) {
+	ctx := context.Background()
+	dsn := newPostgresDSN(t)
+	store, err := NewPostgres(dsn, HashGenerator{})
+	require.NoError(t, err)
+	i1, _, err := store.Add(ctx, "http://www.google.com", "")
+	assert.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	// Reopen the store and check migrations are not applied twice
+	//
+	store, err = NewPostgres(dsn, HashGenerator{})
+	require.NoError(t, err)
+	defer store.Close()
+	url, err := store.Get(ctx, i1)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://www.google.com", url)
+	var versions int
+	require.NoError(t, store.db.QueryRow("SELECT COUNT(*) FROM schema_versions").Scan(&versions))
+	assert.Equal(t, len(postgresQueries.migrations), versions)
+}
+
+func TestMigrateConcurrentlyPostgres(t *testing.T) {
+	dsn := newPostgresDSN(t)
+	testMigrateConcurrently(t, func() (*URLStoreSQL, error) {
+		return NewPostgres(dsn, HashGenerator{})
+	}, len(postgresQueries.migrations))
+}
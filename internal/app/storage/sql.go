@@ -0,0 +1,685 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQL store implementation shared by the SQL databases. It uses a single table with
+// unique indexes on both the short URL and the full URL (aliases aside). The queries
+// are specific to each database and are provided by its constructor. Redirects are
+// kept in the table of click events, and the statistics are counted from them on
+// request. The former full URLs of edited short URLs are kept in the history table,
+// and API keys are kept in their own table.
+
+type sqlQueries struct {
+	lock         string            // taken first in the migration transaction, empty if the transaction locks by itself
+	versions     string            // creates the table of the applied schema versions
+	migrations   [][]string        // schema migrations, each one is applied once in order
+	add          string            // (short, url, owner, expires, max clicks), must do nothing on a conflict
+	getShort     string            // (url) -> short, deleted, expires, max clicks, clicks
+	getURL       string            // (short) -> url, deleted, expires, max clicks, clicks
+	getLink      string            // (short) -> url, owner, deleted, expires, max clicks, clicks
+	addAlias     string            // (alias, url, owner, expires, max clicks), must do nothing on a conflict
+	restore      string            // (owner, expires, max clicks, short, url, alias, now), restores a deleted or expired one as a new one
+	click        string            // (short, now), counts a click if it is allowed
+	delete       string            // (short, owner), marks it deleted
+	purge        string            // (now), removes the expired ones
+	purgeClicks  string            // (now), removes the click events of the expired ones
+	clearClicks  string            // (short), removes the click events of the restored one
+	addClick     string            // (short, time, referrer, user agent, IP hash, short), must do nothing if the short is missing
+	statsDays    string            // (short) -> UTC date, count
+	statsRefs    string            // (short) -> referrer, count
+	update       string            // (url, short, former url, owner), changes it unless it has been changed or deleted
+	addRevision  string            // (short, former url, replaced, short), adds the next version to the history
+	history      string            // (short) -> version, url, replaced, in the version order
+	purgeHistory string            // (now), removes the history of the expired ones
+	clearHistory string            // (short), removes the history of the restored one
+	addKey       string            // (id, hash, owner, scope, created), must do nothing on a conflict
+	getKey       string            // (hash) -> id, owner, scope, created, revoked
+	listKeys     string            // () -> id, hash, owner, scope, created, revoked, in the order of creation
+	revokeKey    string            // (id), marks it revoked
+	list         string            // (owner) -> short, url, without ORDER BY and LIMIT
+	shorts       string            // () -> short, aliases aside
+	columns      map[string]string // sort orders to ORDER BY columns
+	noLimit      string            // LIMIT value for no limit
+	version      string            // () -> the current schema version, 0 if none
+	setVersion   string            // (version)
+}
+
+type URLStoreSQL struct {
+	db       *sql.DB
+	q        sqlQueries
+	g        IDGenerator
+	reserved map[string]bool // short URLs which must not be generated (see Reserver)
+}
+
+func newSQL(db *sql.DB, q sqlQueries, g IDGenerator) (*URLStoreSQL, error) {
+	store := &URLStoreSQL{
+		db: db,
+		q:  q,
+		g:  g,
+	}
+	if err := store.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := store.seed(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// seed() seeds the generator with the short URLs in the table (see seeder)
+
+func (store *URLStoreSQL) seed() error {
+	g, ok := store.g.(seeder)
+	if !ok {
+		return nil
+	}
+	rows, err := store.db.Query(store.q.shorts)
+	if err != nil {
+		return unavailable(errQuery, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var short string
+		if err := rows.Scan(&short); err != nil {
+			return unavailable(errQuery, err)
+		}
+		g.Seed(short)
+	}
+	if err := rows.Err(); err != nil {
+		return unavailable(errQuery, err)
+	}
+	return nil
+}
+
+// migrate() applies the migrations not applied yet in a single transaction, along
+// with the schema version updates. The transaction takes the lock first, so stores
+// opened at once (e.g. by several instances of the service) apply them in turn, and
+// the later ones find them applied.
+
+func (store *URLStoreSQL) migrate() error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: %w", errMigrate, err)
+	}
+	defer tx.Rollback()
+	if store.q.lock != "" {
+		if _, err := tx.Exec(store.q.lock); err != nil {
+			return fmt.Errorf("%s: %w", errMigrate, err)
+		}
+	}
+	if _, err := tx.Exec(store.q.versions); err != nil {
+		return fmt.Errorf("%s: %w", errMigrate, err)
+	}
+	var version int
+	if err := tx.QueryRow(store.q.version).Scan(&version); err != nil {
+		return fmt.Errorf("%s: %w", errMigrate, err)
+	}
+	for ; version < len(store.q.migrations); version++ {
+		for _, query := range store.q.migrations[version] {
+			if _, err := tx.Exec(query); err != nil {
+				return fmt.Errorf("%s: %w", errMigrate, err)
+			}
+		}
+		if _, err := tx.Exec(store.q.setVersion, version+1); err != nil {
+			return fmt.Errorf("%s: %w", errMigrate, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", errMigrate, err)
+	}
+	return nil
+}
+
+// queryError() keeps the context errors as is, and makes other errors unavailable
+
+func queryError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return unavailable(errQuery, err)
+}
+
+// querier is either the database or a transaction
+
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (store *URLStoreSQL) Add(ctx context.Context, url, owner string) (string, bool, error) {
+	return store.add(ctx, store.db, url, owner, AddOptions{})
+}
+
+func (store *URLStoreSQL) AddWithOptions(ctx context.Context, url, owner string, opts AddOptions) (string, bool, error) {
+	if opts.Alias != "" {
+		if err := store.addAlias(ctx, url, owner, opts); err != nil {
+			return "", false, err
+		}
+		return opts.Alias, true, nil
+	}
+	return store.add(ctx, store.db, url, owner, opts)
+}
+
+func (store *URLStoreSQL) AddBatch(ctx context.Context, urls []string, owner string) ([]string, error) {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer tx.Rollback()
+	shorts := make([]string, len(urls))
+	for i, url := range urls {
+		if shorts[i], _, err = store.add(ctx, tx, url, owner, AddOptions{}); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+	return shorts, nil
+}
+
+// Expiration times are kept in Unix milliseconds, 0 means none
+
+func millis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func fromMillis(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+func (store *URLStoreSQL) add(ctx context.Context, q querier, url, owner string, opts AddOptions) (string, bool, error) {
+	for attempt := uint32(0); attempt < maxAttempts; attempt++ {
+		var short string
+		var deleted bool
+		var expiresAt, maxClicks, clicks int64
+		now := time.Now()
+		err := q.QueryRowContext(ctx, store.q.getShort, url).Scan(&short, &deleted, &expiresAt, &maxClicks, &clicks)
+		if err == nil && !deleted && !expired(now, fromMillis(expiresAt), maxClicks, clicks) {
+			return short, false, nil
+		}
+		if err == nil {
+			// Nothing is restored if someone else has just restored it, so check again
+			//
+			ok, err := store.restore(ctx, q, short, url, owner, false, opts, now)
+			if err != nil || ok {
+				return short, ok, err
+			}
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", false, queryError(ctx, err)
+		}
+
+		// Nothing is inserted if either the short URL is taken by another full URL or
+		// the full URL has just been added by someone else, so check again
+		//
+		short = store.g.Generate(url, attempt)
+		if store.reserved[strings.ToLower(short)] {
+			continue
+		}
+		if ok, err := execOne(ctx, q, store.q.add, short, url, owner, millis(opts.ExpiresAt), opts.MaxClicks); err != nil || ok {
+			return short, ok, err
+		}
+	}
+	return "", false, conflict(errNoShort)
+}
+
+// addAlias() restores the alias if it cannot be added, so it is a conflict only if
+// both do nothing
+
+func (store *URLStoreSQL) addAlias(ctx context.Context, url, owner string, opts AddOptions) error {
+	ok, err := execOne(ctx, store.db, store.q.addAlias, opts.Alias, url, owner, millis(opts.ExpiresAt), opts.MaxClicks)
+	if err == nil && !ok {
+		ok, err = store.restore(ctx, store.db, opts.Alias, url, owner, true, opts, time.Now())
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return conflict(errAlias)
+	}
+	return nil
+}
+
+// restore() restores the deleted (or expired) link as a new one, so it removes the
+// click events and the history of the former one in the same transaction: the one of
+// the batch, or a new one
+
+func (store *URLStoreSQL) restore(ctx context.Context, q querier, short, url, owner string, alias bool, opts AddOptions, now time.Time) (bool, error) {
+	tx, ok := q.(*sql.Tx)
+	if !ok {
+		var err error
+		if tx, err = store.db.BeginTx(ctx, nil); err != nil {
+			return false, queryError(ctx, err)
+		}
+		defer tx.Rollback()
+	}
+	restored, err := execOne(ctx, tx, store.q.restore, owner, millis(opts.ExpiresAt), opts.MaxClicks, short, url, alias, now.UnixMilli())
+	if err != nil || !restored {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, store.q.clearClicks, short); err != nil {
+		return false, queryError(ctx, err)
+	}
+	if _, err := tx.ExecContext(ctx, store.q.clearHistory, short); err != nil {
+		return false, queryError(ctx, err)
+	}
+	if !ok {
+		if err := tx.Commit(); err != nil {
+			return false, queryError(ctx, err)
+		}
+	}
+	return true, nil
+}
+
+// execOne() runs the query and tells whether it has affected a row
+
+func execOne(ctx context.Context, q querier, query string, args ...any) (bool, error) {
+	res, err := q.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, queryError(ctx, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, queryError(ctx, err)
+	}
+	return n == 1, nil
+}
+
+// Get() counts the click with a conditional update, so a link with limited clicks is
+// never followed more times than allowed
+
+func (store *URLStoreSQL) Get(ctx context.Context, short string) (string, error) {
+	var url string
+	var deleted bool
+	var expiresAt, maxClicks, clicks int64
+	now := time.Now()
+	err := store.db.QueryRowContext(ctx, store.q.getURL, short).Scan(&url, &deleted, &expiresAt, &maxClicks, &clicks)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", queryError(ctx, err)
+	}
+	if deleted {
+		return "", ErrDeleted
+	}
+	if expired(now, fromMillis(expiresAt), maxClicks, clicks) {
+		return "", ErrExpired
+	}
+	if maxClicks > 0 {
+		ok, err := execOne(ctx, store.db, store.q.click, short, now.UnixMilli())
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", ErrExpired
+		}
+	}
+	return url, nil
+}
+
+func (store *URLStoreSQL) Lookup(ctx context.Context, short string) (string, error) {
+	var url string
+	var deleted bool
+	var expiresAt, maxClicks, clicks int64
+	err := store.db.QueryRowContext(ctx, store.q.getURL, short).Scan(&url, &deleted, &expiresAt, &maxClicks, &clicks)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", queryError(ctx, err)
+	}
+	if deleted {
+		return "", ErrDeleted
+	}
+	if expired(time.Now(), fromMillis(expiresAt), maxClicks, clicks) {
+		return "", ErrExpired
+	}
+	return url, nil
+}
+
+func (store *URLStoreSQL) ListByOwner(ctx context.Context, owner string, opts ListOptions) ([]Link, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if owner == "" {
+		// Links without owners are not listed
+		return []Link{}, nil
+	}
+	if opts.SortBy == "" {
+		opts.SortBy = SortCreated
+	}
+	order, limit := "ASC", store.q.noLimit
+	if opts.Desc {
+		order = "DESC"
+	}
+	if opts.Limit > 0 {
+		limit = strconv.Itoa(opts.Limit)
+	}
+	query := fmt.Sprintf("%s ORDER BY %s %s LIMIT %s OFFSET %d", store.q.list, store.q.columns[opts.SortBy], order, limit, opts.Offset)
+
+	rows, err := store.db.QueryContext(ctx, query, owner)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+	links := []Link{}
+	for rows.Next() {
+		var link Link
+		if err := rows.Scan(&link.Short, &link.URL); err != nil {
+			return nil, queryError(ctx, err)
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+	return links, nil
+}
+
+func (store *URLStoreSQL) DeleteBatch(ctx context.Context, shorts []string, owner string) error {
+	if owner == "" {
+		return ctx.Err()
+	}
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return queryError(ctx, err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, store.q.delete)
+	if err != nil {
+		return queryError(ctx, err)
+	}
+	defer stmt.Close()
+	for _, short := range shorts {
+		if _, err := stmt.ExecContext(ctx, short, owner); err != nil {
+			return queryError(ctx, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return queryError(ctx, err)
+	}
+	return nil
+}
+
+// PurgeExpired() removes the click events along with the links, so the statistics do
+// not pass to the next links with the same short URLs
+
+func (store *URLStoreSQL) PurgeExpired(ctx context.Context) (int, error) {
+	now := time.Now().UnixMilli()
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, queryError(ctx, err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, store.q.purgeClicks, now); err != nil {
+		return 0, queryError(ctx, err)
+	}
+	if _, err := tx.ExecContext(ctx, store.q.purgeHistory, now); err != nil {
+		return 0, queryError(ctx, err)
+	}
+	res, err := tx.ExecContext(ctx, store.q.purge, now)
+	if err != nil {
+		return 0, queryError(ctx, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, queryError(ctx, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, queryError(ctx, err)
+	}
+	return int(n), nil
+}
+
+func (store *URLStoreSQL) AddClicks(ctx context.Context, clicks []Click) error {
+	if len(clicks) == 0 {
+		return ctx.Err()
+	}
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return queryError(ctx, err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, store.q.addClick)
+	if err != nil {
+		return queryError(ctx, err)
+	}
+	defer stmt.Close()
+	for _, c := range clicks {
+		if _, err := stmt.ExecContext(ctx, c.Short, c.Time.UnixMilli(), c.Referrer, c.UserAgent, c.IPHash, c.Short); err != nil {
+			return queryError(ctx, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return queryError(ctx, err)
+	}
+	return nil
+}
+
+func (store *URLStoreSQL) Stats(ctx context.Context, short, owner string) (Stats, error) {
+	if _, err := store.link(ctx, store.db, short, owner); err != nil {
+		return Stats{}, err
+	}
+	stats := newStats()
+	if err := store.count(ctx, store.q.statsDays, short, stats.Days); err != nil {
+		return Stats{}, err
+	}
+	if err := store.count(ctx, store.q.statsRefs, short, stats.Referrers); err != nil {
+		return Stats{}, err
+	}
+	for _, n := range stats.Days {
+		stats.Total += n
+	}
+	return *stats, nil
+}
+
+// Update() changes the full URL only if it is the same as it has been checked, and
+// checks again otherwise. The history is added to in the same transaction, which the
+// update keeps others from changing the link along with.
+
+func (store *URLStoreSQL) Update(ctx context.Context, short, url, owner string) error {
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		done, err := store.update(ctx, short, url, owner)
+		if err != nil || done {
+			return err
+		}
+	}
+	return conflict(errUpdate)
+}
+
+func (store *URLStoreSQL) update(ctx context.Context, short, url, owner string) (bool, error) {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, queryError(ctx, err)
+	}
+	defer tx.Rollback()
+	l, err := store.link(ctx, tx, short, owner)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	switch {
+	case l.deleted:
+		return false, ErrDeleted
+	case expired(now, fromMillis(l.expiresAt), l.maxClicks, l.clicks):
+		return false, ErrExpired
+	case l.url == url:
+		return true, nil
+	}
+	if ok, err := execOne(ctx, tx, store.q.update, url, short, l.url, owner); err != nil || !ok {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, store.q.addRevision, short, l.url, now.UnixMilli(), short); err != nil {
+		return false, queryError(ctx, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, queryError(ctx, err)
+	}
+	return true, nil
+}
+
+func (store *URLStoreSQL) History(ctx context.Context, short, owner string) ([]Revision, error) {
+	l, err := store.link(ctx, store.db, short, owner)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := store.db.QueryContext(ctx, store.q.history, short)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+	revisions := []Revision{}
+	for rows.Next() {
+		var rev Revision
+		var replacedAt int64
+		if err := rows.Scan(&rev.Version, &rev.URL, &replacedAt); err != nil {
+			return nil, queryError(ctx, err)
+		}
+		rev.ReplacedAt = fromMillis(replacedAt)
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+	return append(revisions, Revision{Version: int64(len(revisions) + 1), URL: l.url}), nil
+}
+
+type sqlLink struct {
+	url       string
+	deleted   bool
+	expiresAt int64
+	maxClicks int64
+	clicks    int64
+}
+
+// link() gives the owner's short URL
+
+func (store *URLStoreSQL) link(ctx context.Context, q querier, short, owner string) (sqlLink, error) {
+	var l sqlLink
+	var linkOwner string
+	err := q.QueryRowContext(ctx, store.q.getLink, short).Scan(&l.url, &linkOwner, &l.deleted, &l.expiresAt, &l.maxClicks, &l.clicks)
+	if errors.Is(err, sql.ErrNoRows) {
+		return l, ErrNotFound
+	}
+	if err != nil {
+		return l, queryError(ctx, err)
+	}
+	if owner == "" || linkOwner != owner {
+		return l, ErrForbidden
+	}
+	return l, nil
+}
+
+// count() puts the counts grouped by the query into the map
+
+func (store *URLStoreSQL) count(ctx context.Context, query, short string, counts map[string]int64) error {
+	rows, err := store.db.QueryContext(ctx, query, short)
+	if err != nil {
+		return queryError(ctx, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var n int64
+		if err := rows.Scan(&key, &n); err != nil {
+			return queryError(ctx, err)
+		}
+		counts[key] = n
+	}
+	if err := rows.Err(); err != nil {
+		return queryError(ctx, err)
+	}
+	return nil
+}
+
+func (store *URLStoreSQL) AddKey(ctx context.Context, key APIKey) error {
+	ok, err := execOne(ctx, store.db, store.q.addKey, key.ID, key.Hash, key.Owner, key.Scope, key.CreatedAt.UnixMilli())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return conflict(errKey)
+	}
+	return nil
+}
+
+func (store *URLStoreSQL) GetKey(ctx context.Context, hash string) (APIKey, error) {
+	key := APIKey{Hash: hash}
+	var createdAt int64
+	err := store.db.QueryRowContext(ctx, store.q.getKey, hash).Scan(&key.ID, &key.Owner, &key.Scope, &createdAt, &key.Revoked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, ErrNotFound
+	}
+	if err != nil {
+		return APIKey{}, queryError(ctx, err)
+	}
+	key.CreatedAt = time.UnixMilli(createdAt)
+	return key, nil
+}
+
+func (store *URLStoreSQL) ListKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := store.db.QueryContext(ctx, store.q.listKeys)
+	if err != nil {
+		return nil, queryError(ctx, err)
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		var createdAt int64
+		if err := rows.Scan(&key.ID, &key.Hash, &key.Owner, &key.Scope, &createdAt, &key.Revoked); err != nil {
+			return nil, queryError(ctx, err)
+		}
+		key.CreatedAt = time.UnixMilli(createdAt)
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, queryError(ctx, err)
+	}
+	return keys, nil
+}
+
+func (store *URLStoreSQL) RevokeKey(ctx context.Context, id string) error {
+	ok, err := execOne(ctx, store.db, store.q.revokeKey, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (store *URLStoreSQL) Reserve(names map[string]bool) {
+	store.reserved = names
+}
+
+func (store *URLStoreSQL) Ping(ctx context.Context) error {
+	if err := store.db.PingContext(ctx); err != nil {
+		return queryError(ctx, err)
+	}
+	return nil
+}
+
+func (store *URLStoreSQL) Close() error {
+	return store.db.Close()
+}
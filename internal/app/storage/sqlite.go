@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLite store implementation. It uses the embedded pure Go SQLite database, so the
+// whole store is a single file without any server to run.
+
+const sqlitePrefix = "sqlite:"
+
+var sqliteQueries = sqlQueries{
+	// Transactions take the write lock at the start (see NewSQLite()), so the migration
+	// one needs no other lock
+	//
+	versions: `CREATE TABLE IF NOT EXISTS schema_versions (version INTEGER PRIMARY KEY)`,
+	migrations: [][]string{
+		{
+			`CREATE TABLE urls (
+				short_url    TEXT NOT NULL,
+				original_url TEXT NOT NULL
+			)`,
+			`CREATE UNIQUE INDEX urls_short_url ON urls (short_url)`,
+			`CREATE UNIQUE INDEX urls_original_url ON urls (original_url)`,
+		},
+		{
+			`ALTER TABLE urls ADD COLUMN owner TEXT NOT NULL DEFAULT ''`,
+		},
+		{
+			`CREATE INDEX urls_owner ON urls (owner)`,
+		},
+		{
+			`ALTER TABLE urls ADD COLUMN is_deleted BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+		{
+			// A full URL may have several aliases, but only one generated short URL
+			`ALTER TABLE urls ADD COLUMN is_alias BOOLEAN NOT NULL DEFAULT FALSE`,
+			`DROP INDEX urls_original_url`,
+			`CREATE UNIQUE INDEX urls_original_url ON urls (original_url) WHERE NOT is_alias`,
+		},
+		{
+			`ALTER TABLE urls ADD COLUMN expires_at BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE urls ADD COLUMN max_clicks BIGINT NOT NULL DEFAULT 0`,
+			`ALTER TABLE urls ADD COLUMN clicks BIGINT NOT NULL DEFAULT 0`,
+		},
+		{
+			`CREATE TABLE click_events (
+				short_url  TEXT NOT NULL,
+				clicked_at BIGINT NOT NULL,
+				referrer   TEXT NOT NULL,
+				user_agent TEXT NOT NULL,
+				ip_hash    TEXT NOT NULL
+			)`,
+			`CREATE INDEX click_events_short_url ON click_events (short_url)`,
+		},
+		{
+			`CREATE TABLE url_history (
+				short_url    TEXT NOT NULL,
+				version      BIGINT NOT NULL,
+				original_url TEXT NOT NULL,
+				replaced_at  BIGINT NOT NULL
+			)`,
+			`CREATE UNIQUE INDEX url_history_short_url ON url_history (short_url, version)`,
+		},
+		{
+			`CREATE TABLE api_keys (
+				id         TEXT NOT NULL,
+				key_hash   TEXT NOT NULL,
+				owner      TEXT NOT NULL,
+				scope      TEXT NOT NULL,
+				created_at BIGINT NOT NULL,
+				is_revoked BOOLEAN NOT NULL DEFAULT FALSE
+			)`,
+			`CREATE UNIQUE INDEX api_keys_id ON api_keys (id)`,
+			`CREATE UNIQUE INDEX api_keys_key_hash ON api_keys (key_hash)`,
+		},
+	},
+	add:      `INSERT INTO urls (short_url, original_url, owner, expires_at, max_clicks) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+	getShort: `SELECT short_url, is_deleted, expires_at, max_clicks, clicks FROM urls WHERE original_url = ? AND NOT is_alias`,
+	getURL:   `SELECT original_url, is_deleted, expires_at, max_clicks, clicks FROM urls WHERE short_url = ?`,
+	getLink:  `SELECT original_url, owner, is_deleted, expires_at, max_clicks, clicks FROM urls WHERE short_url = ?`,
+	restore: `UPDATE urls SET owner = ?, expires_at = ?, max_clicks = ?, clicks = 0, is_deleted = FALSE, rowid = (SELECT MAX(rowid) FROM urls) + 1
+		WHERE short_url = ? AND original_url = ? AND is_alias = ?
+		AND (is_deleted OR expires_at > 0 AND expires_at <= ? OR max_clicks > 0 AND clicks >= max_clicks)`,
+	addAlias: `INSERT INTO urls (short_url, original_url, owner, expires_at, max_clicks, is_alias) VALUES (?, ?, ?, ?, ?, TRUE) ON CONFLICT DO NOTHING`,
+	click:    `UPDATE urls SET clicks = clicks + 1 WHERE short_url = ? AND NOT is_deleted AND (expires_at = 0 OR expires_at > ?) AND clicks < max_clicks`,
+	delete:   `UPDATE urls SET is_deleted = TRUE WHERE short_url = ? AND owner = ?`,
+	purge:    `DELETE FROM urls WHERE expires_at > 0 AND expires_at <= ? OR max_clicks > 0 AND clicks >= max_clicks`,
+	purgeClicks: `DELETE FROM click_events WHERE short_url IN
+		(SELECT short_url FROM urls WHERE expires_at > 0 AND expires_at <= ? OR max_clicks > 0 AND clicks >= max_clicks)`,
+	clearClicks: `DELETE FROM click_events WHERE short_url = ?`,
+	addClick: `INSERT INTO click_events (short_url, clicked_at, referrer, user_agent, ip_hash)
+		SELECT ?, ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM urls WHERE short_url = ?)`,
+	statsDays: `SELECT strftime('%Y-%m-%d', clicked_at / 1000, 'unixepoch'), COUNT(*) FROM click_events WHERE short_url = ? GROUP BY 1`,
+	statsRefs: `SELECT referrer, COUNT(*) FROM click_events WHERE short_url = ? GROUP BY referrer`,
+	update:    `UPDATE urls SET original_url = ?, is_alias = TRUE WHERE short_url = ? AND original_url = ? AND owner = ? AND NOT is_deleted`,
+	addRevision: `INSERT INTO url_history (short_url, version, original_url, replaced_at)
+		SELECT ?, COALESCE(MAX(version), 0) + 1, ?, ? FROM url_history WHERE short_url = ?`,
+	history: `SELECT version, original_url, replaced_at FROM url_history WHERE short_url = ? ORDER BY version`,
+	purgeHistory: `DELETE FROM url_history WHERE short_url IN
+		(SELECT short_url FROM urls WHERE expires_at > 0 AND expires_at <= ? OR max_clicks > 0 AND clicks >= max_clicks)`,
+	clearHistory: `DELETE FROM url_history WHERE short_url = ?`,
+	addKey:       `INSERT INTO api_keys (id, key_hash, owner, scope, created_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+	getKey:       `SELECT id, owner, scope, created_at, is_revoked FROM api_keys WHERE key_hash = ?`,
+	listKeys:     `SELECT id, key_hash, owner, scope, created_at, is_revoked FROM api_keys ORDER BY created_at, id`,
+	revokeKey:    `UPDATE api_keys SET is_revoked = TRUE WHERE id = ?`,
+	list:         `SELECT short_url, original_url FROM urls WHERE owner = ? AND NOT is_deleted`,
+	shorts:       `SELECT short_url FROM urls WHERE NOT is_alias`,
+	columns: map[string]string{
+		// New rowids are larger than the existing ones, and restored rows get a new one,
+		// so rowid keeps the order they have been added in
+		SortCreated: "rowid",
+		SortShort:   "short_url",
+		SortURL:     "original_url",
+	},
+	noLimit:    "-1",
+	version:    `SELECT COALESCE(MAX(version), 0) FROM schema_versions`,
+	setVersion: `INSERT INTO schema_versions (version) VALUES (?)`,
+}
+
+func NewSQLite(filename string, g IDGenerator) (*URLStoreSQL, error) {
+	// Wait for locks instead of failing at once, let readers work along with the
+	// writer, and take the write lock at the start of transactions to avoid deadlocks
+	//
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate", filename)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", errOpen, err)
+	}
+	return newSQL(db, sqliteQueries, g)
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddCollisionSQLite(t *testing.T) {
+	defer forceCollisions()()
+	store, err := NewSQLite(filepath.Join(t.TempDir(), "test.db"), HashGenerator{})
+	require.NoError(t, err)
+	defer store.Close()
+	testAddCollision(t, store)
+}
+
+func TestReserveSQLite(t *testing.T) {
+	store, err := NewSQLite(filepath.Join(t.TempDir(), "test.db"), listGenerator{"Ping", "api", "abc"})
+	require.NoError(t, err)
+	defer store.Close()
+	testReserve(t, store)
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewSQLite(filename, HashGenerator{})
+	require.NoError(t, err)
+	i1, _, err := store.Add(ctx, "http://www.google.com", "")
+	assert.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	// Reopen the store and check migrations are not applied twice
+	//
+	store, err = NewSQLite(filename, HashGenerator{})
+	require.NoError(t, err)
+	defer store.Close()
+	url, err := store.Get(ctx, i1)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://www.google.com", url)
+	var versions int
+	require.NoError(t, store.db.QueryRow("SELECT COUNT(*) FROM schema_versions").Scan(&versions))
+	assert.Equal(t, len(sqliteQueries.migrations), versions)
+}
+
+func TestMigrateConcurrentlySQLite(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+	testMigrateConcurrently(t, func() (*URLStoreSQL, error) {
+		return NewSQLite(filename, HashGenerator{})
+	}, len(sqliteQueries.migrations))
+}
+
+func TestAddNoShortSQLite(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewSQLite(filepath.Join(t.TempDir(), "test.db"), constGenerator{})
+	require.NoError(t, err)
+	defer store.Close()
+	_, _, err = store.Add(ctx, "http://www.google.com", "")
+	assert.NoError(t, err)
+	_, _, err = store.Add(ctx, "http://www.yandex.ru", "")
+	assert.ErrorIs(t, err, ErrConflict)
+}
+
+func TestAddBatchNoShortSQLite(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewSQLite(filepath.Join(t.TempDir(), "test.db"), constGenerator{})
+	require.NoError(t, err)
+	defer store.Close()
+
+	// The batch must be added either as a whole, or not at all
+	//
+	_, err = store.AddBatch(ctx, []string{"http://www.google.com", "http://www.yandex.ru"}, "")
+	assert.ErrorIs(t, err, ErrConflict)
+	_, err = store.Get(ctx, "abc")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestOwnerSQLite(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewSQLite(filepath.Join(t.TempDir(), "test.db"), HashGenerator{})
+	require.NoError(t, err)
+	defer store.Close()
+	i1, _, err := store.Add(ctx, "http://www.google.com", "user1")
+	require.NoError(t, err)
+	_, _, err = store.Add(ctx, "http://www.google.com", "user2")
+	require.NoError(t, err)
+
+	var owner string
+	require.NoError(t, store.db.QueryRow("SELECT owner FROM urls WHERE short_url = ?", i1).Scan(&owner))
+	assert.Equal(t, "user1", owner)
+}
@@ -1,39 +1,347 @@
 package storage
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
 )
 
+// Add() returns the short URL and true if it is new, or the existing short URL and
+// false if the URL has been already added. AddBatch() adds all the URLs transactionally
+// and returns the short URLs in the same order. Duplicates (in the store or in the
+// batch) get the short URLs already made. The owner (if not empty) is the user who has
+// added the new short URLs, the owners of the existing ones stay the same.
+
+// ListByOwner() returns the short URLs added by the owner (and their full URLs) sorted
+// and paginated according to the options.
+
+// DeleteBatch() marks the owner's short URLs as deleted, the ones of other owners and
+// missing ones are skipped. Get() returns ErrDeleted for them, and the short URLs are
+// never given to other full URLs. Adding the full URL again restores its short URL.
+
+// Get() returns ErrExpired for the expired links, and counts redirects of the links
+// with limited clicks. Expired links are restored the same way as deleted ones until
+// PurgeExpired() removes them along with their owners, so their short URLs become free.
+// Lookup() is Get() without counting the redirect, so it never uses up the clicks.
+
+// AddWithOptions() is Add() with the options of the new link. If the alias is given,
+// it is the short URL instead of a generated one, and ErrConflict is returned if it is
+// taken. A full URL may have several aliases, and Add() still makes its own short URL
+// for it. A deleted (or expired) alias may only be restored for the same full URL.
+// The options are ignored if the existing short URL is returned.
+
+// AddClicks() records the redirects, the ones of missing short URLs are skipped. Stats()
+// returns the statistics of the owner's short URL (even if it is deleted or expired),
+// ErrForbidden if it is someone else's one (or nobody's), or ErrNotFound if it is
+// missing. Purged links lose their statistics, and restored ones start without them.
+
+// Update() changes the full URL of the owner's short URL, and returns ErrForbidden if
+// it is someone else's one (or nobody's). The short URL is handled like an alias after
+// that, as it is no longer the one made of its full URL. History() returns the full
+// URLs the short URL has had (the current one last) to its owner. Both the statistics
+// and the history are kept until the link is purged or restored as a new one.
+
+// AddKey() stores the API key, and returns ErrConflict if its ID or its hash is taken.
+// GetKey() finds the key by the hash of its secret (the revoked ones too), or returns
+// ErrNotFound. ListKeys() returns all the keys in the order they have been created in.
+// RevokeKey() marks the key revoked for good, or returns ErrNotFound if it is missing.
+
+// Ping() checks that the store is able to serve requests, e.g. the file store is still
+// writable or the database is reachable. Once Close() is called, the store returns
+// ErrUnavailable on any request.
+
 type URLStorer interface {
-	Add(url string) (string, error)
-	Get(short string) (string, error)
+	Add(ctx context.Context, url, owner string) (string, bool, error)
+	AddWithOptions(ctx context.Context, url, owner string, opts AddOptions) (string, bool, error)
+	AddBatch(ctx context.Context, urls []string, owner string) ([]string, error)
+	Get(ctx context.Context, short string) (string, error)
+	Lookup(ctx context.Context, short string) (string, error)
+	ListByOwner(ctx context.Context, owner string, opts ListOptions) ([]Link, error)
+	DeleteBatch(ctx context.Context, shorts []string, owner string) error
+	PurgeExpired(ctx context.Context) (int, error)
+	AddClicks(ctx context.Context, clicks []Click) error
+	Stats(ctx context.Context, short, owner string) (Stats, error)
+	Update(ctx context.Context, short, url, owner string) error
+	History(ctx context.Context, short, owner string) ([]Revision, error)
+	AddKey(ctx context.Context, key APIKey) error
+	GetKey(ctx context.Context, hash string) (APIKey, error)
+	ListKeys(ctx context.Context) ([]APIKey, error)
+	RevokeKey(ctx context.Context, id string) error
+	Ping(ctx context.Context) error
 	Close() error
 }
 
+// Reserver is a URLStorer which never generates the short URLs it is told to reserve
+// (in any case, the names are in lower case), e.g. the first path segments the router
+// serves, as such short URLs could never be reached. Aliases are not checked, as they
+// are validated before. Reserve() must be called before the store is used.
+
+type Reserver interface {
+	Reserve(names map[string]bool)
+}
+
+// AddOptions sets the alias of a new link and when it expires: at the time or after
+// the number of redirects. Zero values mean no alias and no expiration.
+
+type AddOptions struct {
+	Alias     string
+	ExpiresAt time.Time
+	MaxClicks int64
+}
+
+// expired() tells whether a link has expired by the time or by the number of clicks
+
+func expired(now, expiresAt time.Time, maxClicks, clicks int64) bool {
+	return !expiresAt.IsZero() && !now.Before(expiresAt) || maxClicks > 0 && clicks >= maxClicks
+}
+
+// Click is a redirect of a short URL. The referrer is the host of the referring page
+// (if any), and the IP address is hashed, so it is not kept as is.
+
+type Click struct {
+	Short     string
+	Time      time.Time
+	Referrer  string
+	UserAgent string
+	IPHash    string
+}
+
+// Stats counts the redirects of a short URL: total, by UTC dates (in the 2006-01-02
+// format) and by referrers
+
+type Stats struct {
+	Total     int64
+	Days      map[string]int64
+	Referrers map[string]int64
+}
+
+const dayFormat = "2006-01-02"
+
+func newStats() *Stats {
+	return &Stats{Days: map[string]int64{}, Referrers: map[string]int64{}}
+}
+
+func (s *Stats) add(c Click) {
+	s.Total++
+	s.Days[c.Time.UTC().Format(dayFormat)]++
+	s.Referrers[c.Referrer]++
+}
+
+func (s *Stats) merge(other *Stats) {
+	s.Total += other.Total
+	for k, v := range other.Days {
+		s.Days[k] += v
+	}
+	for k, v := range other.Referrers {
+		s.Referrers[k] += v
+	}
+}
+
+// Revision is a full URL of a short URL. Versions start from 1, and the current full
+// URL has no replacement time.
+
+type Revision struct {
+	Version    int64
+	URL        string
+	ReplacedAt time.Time
+}
+
+// APIKey is a credential of a programmatic client. The store keeps only the hash of
+// the secret, never the secret itself. The links added with the key belong to the owner,
+// and the scope tells what the key may be used for.
+
+type APIKey struct {
+	ID        string
+	Hash      string
+	Owner     string
+	Scope     string
+	CreatedAt time.Time
+	Revoked   bool
+}
+
+// sortKeys() puts the keys in the order they have been created in (by IDs if at the
+// same time)
+
+func sortKeys(keys []APIKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+}
+
+type Link struct {
+	Short string
+	URL   string
+}
+
 const (
-	errNoURL = "URL does not exist in the store"
-	errOpen  = "error opening the file store"
+	SortCreated = "created"
+	SortShort   = "short_url"
+	SortURL     = "original_url"
+)
+
+// ListOptions sets the order of links (the order they have been added in by default)
+// and the page of them to return. Zero Limit means no limit.
+
+type ListOptions struct {
+	SortBy string
+	Desc   bool
+	Offset int
+	Limit  int
+}
+
+// page() sorts the links (which must be in the order they have been added in) and
+// cuts the page out of them
+
+func (opts ListOptions) page(links []Link) []Link {
+	switch opts.SortBy {
+	case SortShort:
+		sort.SliceStable(links, func(i, j int) bool { return links[i].Short < links[j].Short })
+	case SortURL:
+		sort.SliceStable(links, func(i, j int) bool { return links[i].URL < links[j].URL })
+	}
+	if opts.Desc {
+		for i, j := 0, len(links)-1; i < j; i, j = i+1, j-1 {
+			links[i], links[j] = links[j], links[i]
+		}
+	}
+	if opts.Offset >= len(links) {
+		return []Link{}
+	}
+	links = links[opts.Offset:]
+	if opts.Limit > 0 && opts.Limit < len(links) {
+		links = links[:opts.Limit]
+	}
+	return links
+}
+
+func (opts ListOptions) validate() error {
+	switch opts.SortBy {
+	case "", SortCreated, SortShort, SortURL:
+	default:
+		return fmt.Errorf("%s: %q", errSort, opts.SortBy)
+	}
+	if opts.Offset < 0 || opts.Limit < 0 {
+		return errors.New(errPage)
+	}
+	return nil
+}
+
+// Errors of the stores, use errors.Is() to check for them. A store may also return
+// the context errors if the context is done.
+
+var (
+	ErrNotFound    = errors.New("URL does not exist in the store")
+	ErrConflict    = errors.New("URL conflicts with the store")
+	ErrDeleted     = errors.New("URL has been deleted from the store")
+	ErrExpired     = errors.New("URL has expired")
+	ErrForbidden   = errors.New("URL belongs to another user")
+	ErrUnavailable = errors.New("store is unavailable")
+)
+
+// storeError keeps both the kind of an error (one of the errors above) and its cause
+
+type storeError struct {
+	kind error
+	msg  string
+	err  error
+}
+
+func (e *storeError) Error() string {
+	if e.err == nil {
+		return e.msg
+	}
+	return e.msg + ": " + e.err.Error()
+}
+
+func (e *storeError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *storeError) Unwrap() error {
+	return e.err
+}
+
+func unavailable(msg string, err error) error {
+	return &storeError{kind: ErrUnavailable, msg: msg, err: err}
+}
+
+func conflict(msg string) error {
+	return &storeError{kind: ErrConflict, msg: msg}
+}
+
+// Stores give up looking for a free short URL after this number of attempts
+
+const maxAttempts = 1000
+
+const (
+	errOpen  = "error opening the store"
 	errRead  = "error reading the file store"
 	errWrite = "error writing the file store"
 	errClose = "error closing the file store"
+
+	errRecord  = "broken record in the file store"
+	errVersion = "unsupported file store format"
+	errCorrupt = "file store is corrupted"
+	errCompact = "error compacting the file store"
+	errMoved   = "file store has been moved or removed"
+
+	errMigrate = "error migrating the database store"
+	errQuery   = "error querying the database store"
+
+	errPing      = "store is not reachable"
+	errClosed    = "store is closed"
+	errNoShort   = "no free short URL is found"
+	errAlias     = "short URL is already taken"
+	errUpdate    = "short URL keeps being changed"
+	errKey       = "API key is already taken"
+	errSort      = "unknown sort order"
+	errPage      = "page offset and limit must not be negative"
+	errGenerator = "unknown short URL generator"
+	errLength    = "short URL length must be positive"
 )
 
-// All implementations use 32-bit FNV-1a hashes and Base64 encoding (URL safe)
+// Hash generator uses 32-bit FNV-1a hashes and Base64 encoding (URL safe). If the
+// short URL is already taken by another full URL, the caller retries with the next
+// attempt number, which is appended to the hash to make a longer short URL. This way
+// a short URL never redirects somewhere else, and the result is still deterministic.
 
-func encode(url string) string {
-	b := make([]byte, 4)
+var hash = func(b []byte) uint32 {
 	h := fnv.New32a()
-	h.Write([]byte(url))
-	binary.LittleEndian.PutUint32(b, h.Sum32())
+	h.Write(b)
+	return h.Sum32()
+}
+
+func encode(url string, attempt uint32) string {
+	b := make([]byte, 4, 8)
+	binary.LittleEndian.PutUint32(b, hash([]byte(url)))
+	if attempt > 0 {
+		b = binary.LittleEndian.AppendUint32(b, attempt)
+	}
 	return base64.URLEncoding.EncodeToString(b)
 }
 
-func New(f string) (URLStorer, error) {
-	if f != "" {
-		return NewFile(f)
-	} else {
-		return NewMemory()
+// New() chooses the store: the PostgreSQL store if the database DSN is given, or else
+// by the file DSN: an empty one is for the memory store, the one with "sqlite:" prefix
+// is for the SQLite store, and any other one is the file store path
+
+func New(databaseDSN, fileDSN string, g IDGenerator, p CompactPolicy) (URLStorer, error) {
+	switch {
+	case databaseDSN != "":
+		return NewPostgres(databaseDSN, g)
+	case fileDSN == "":
+		return NewMemory(g)
+	case strings.HasPrefix(fileDSN, sqlitePrefix):
+		return NewSQLite(strings.TrimPrefix(fileDSN, sqlitePrefix), g)
+	default:
+		return NewFile(fileDSN, g, p)
 	}
 }
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// forceCollisions() replaces the hash function with a constant one, so every full URL
+// gets the same hash. It returns a function to restore the original hash function.
+
+func forceCollisions() func() {
+	h := hash
+	hash = func(b []byte) uint32 {
+		return 42
+	}
+	return func() {
+		hash = h
+	}
+}
+
+// testAddCollision() checks that the full URLs with the same hash get short URLs of
+// their own, it must be called along with forceCollisions()
+
+func testAddCollision(t *testing.T, store URLStorer) {
+	ctx := context.Background()
+
+	// Try to add few with the same hash and check each gets its own short URL
+	//
+	urls := []string{"http://www.google.com", "http://www.yandex.ru", "http://www.mail.ru"}
+	ids := map[string]bool{}
+	for _, u := range urls {
+		id, _, err := store.Add(ctx, u, "")
+		assert.NoError(t, err)
+		assert.False(t, ids[id])
+		ids[id] = true
+		url, err := store.Get(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, u, url)
+	}
+
+	// Try to add a colliding duplicate and check
+	//
+	id, _, err := store.Add(ctx, "http://www.yandex.ru", "")
+	assert.NoError(t, err)
+	url, err := store.Get(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://www.yandex.ru", url)
+}
+
+// owners() gives the owners of the short URLs in the memory store (or in the index of
+// another store), and aliases() gives the aliases
+
+func owners(store *URLStore) map[string]string {
+	o := map[string]string{}
+	for short, r := range store.links {
+		if r.owner != "" {
+			o[short] = r.owner
+		}
+	}
+	return o
+}
+
+func aliases(store *URLStore) map[string]bool {
+	a := map[string]bool{}
+	for short, r := range store.links {
+		if r.alias {
+			a[short] = true
+		}
+	}
+	return a
+}
+
+// testMigrateConcurrently() opens several stores at once on the same new database,
+// and checks that the migrations are applied once
+
+func testMigrateConcurrently(t *testing.T, open func() (*URLStoreSQL, error), migrations int) {
+	stores := make([]*URLStoreSQL, 5)
+	errs := make([]error, len(stores))
+	var wg sync.WaitGroup
+	for i := range stores {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stores[i], errs[i] = open()
+		}(i)
+	}
+	wg.Wait()
+	for i, store := range stores {
+		if assert.NoError(t, errs[i]) {
+			defer store.Close()
+		}
+	}
+	if t.Failed() {
+		return
+	}
+	var versions int
+	assert.NoError(t, stores[0].db.QueryRow("SELECT COUNT(*) FROM schema_versions").Scan(&versions))
+	assert.Equal(t, migrations, versions)
+}
+
+// listGenerator gives the short URLs of the list by the attempt numbers
+
+type listGenerator []string
+
+func (g listGenerator) Generate(url string, attempt uint32) string {
+	return g[int(attempt)%len(g)]
+}
+
+// testReserve() checks that the reserved names are skipped in any case, the store must
+// use listGenerator{"Ping", "api", "abc"}
+
+func testReserve(t *testing.T, store URLStorer) {
+	ctx := context.Background()
+	store.(Reserver).Reserve(map[string]bool{"ping": true, "api": true})
+	id, created, err := store.Add(ctx, "http://www.google.com", "")
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, "abc", id)
+}
+
+func TestEncode(t *testing.T) {
+	// Encoding must be deterministic and keep the original format for the 1st attempt
+	//
+	assert.Equal(t, "lFCg5Q==", encode("http://www.google.com", 0))
+	assert.Equal(t, encode("http://www.google.com", 1), encode("http://www.google.com", 1))
+
+	// Each attempt must give a different short URL even if hashes collide
+	//
+	defer forceCollisions()()
+	seen := map[string]bool{}
+	for attempt := uint32(0); attempt < 100; attempt++ {
+		short := encode("http://www.google.com", attempt)
+		assert.False(t, seen[short])
+		seen[short] = true
+	}
+}
@@ -0,0 +1,1053 @@
+// Package storagetest is the conformance test suite for URLStorer implementations. Any
+// store (including a new one) runs the same tests to be validated identically:
+//
+//	func TestMyStore(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storagetest.Opener {
+//			dsn := ... // a new empty store for each test
+//			return func() (storage.URLStorer, error) {
+//				return NewMyStore(dsn)
+//			}
+//		})
+//	}
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nickeroshenkov/urlShortener/internal/app/storage"
+)
+
+// Opener opens the same store each time it is called. The store is empty on the 1st
+// call. If the store is persistent, next calls (after Close()) open it with the data
+// added before. Otherwise Opener should return nil on next calls.
+
+type Opener func() (storage.URLStorer, error)
+
+// Run() runs all the tests of the suite, newOpener() is called to get an empty store
+// for each test.
+
+func Run(t *testing.T, newOpener func(t *testing.T) Opener) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, open Opener)
+	}{
+		{"Missing", testMissing},
+		{"Context", testContext},
+		{"AddGet", testAddGet},
+		{"Duplicates", testDuplicates},
+		{"Batch", testBatch},
+		{"ListByOwner", testListByOwner},
+		{"DeleteBatch", testDeleteBatch},
+		{"AddAlias", testAddAlias},
+		{"Expiry", testExpiry},
+		{"Stats", testStats},
+		{"Restore", testRestore},
+		{"Update", testUpdate},
+		{"Keys", testKeys},
+		{"Concurrency", testConcurrency},
+		{"Ping", testPing},
+		{"Close", testClose},
+		{"Persistence", testPersistence},
+		{"Reopen", testReopen},
+		{"LargeData", testLargeData},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newOpener(t))
+		})
+	}
+}
+
+func openStore(t *testing.T, open Opener) storage.URLStorer {
+	store, err := open()
+	require.NoError(t, err)
+	require.NotNil(t, store)
+	return store
+}
+
+// addAlias() adds the full URL with the alias, which must be the short URL then
+
+func addAlias(ctx context.Context, t *testing.T, store storage.URLStorer, alias, url, owner string) error {
+	short, created, err := store.AddWithOptions(ctx, url, owner, storage.AddOptions{Alias: alias})
+	if err == nil {
+		assert.Equal(t, alias, short)
+		assert.True(t, created)
+	}
+	return err
+}
+
+func testMissing(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	defer store.Close()
+
+	// Try to get without adding first
+	//
+	_, err := store.Get(ctx, "0")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = store.Get(ctx, "")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// Try to get a missing one after adding others
+	//
+	_, _, err = store.Add(ctx, "http://www.google.com", "")
+	require.NoError(t, err)
+	_, err = store.Get(ctx, "0")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = store.Lookup(ctx, "0")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func testContext(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	defer store.Close()
+	id, _, err := store.Add(ctx, "http://www.google.com", "")
+	require.NoError(t, err)
+
+	// Stores must not serve requests with the context done
+	//
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = store.Add(ctx, "http://www.yandex.ru", "")
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = store.AddBatch(ctx, []string{"http://www.yandex.ru"}, "")
+	assert.ErrorIs(t, err, context.Canceled)
+	err = addAlias(ctx, t, store, "yandex", "http://www.yandex.ru", "")
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = store.ListByOwner(ctx, "user1", storage.ListOptions{})
+	assert.ErrorIs(t, err, context.Canceled)
+	err = store.DeleteBatch(ctx, []string{id}, "user1")
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = store.PurgeExpired(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	err = store.AddClicks(ctx, []storage.Click{{Short: id, Time: time.Now()}})
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = store.Stats(ctx, id, "")
+	assert.ErrorIs(t, err, context.Canceled)
+	err = store.Update(ctx, id, "http://www.yandex.ru", "")
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = store.History(ctx, id, "")
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = store.Get(ctx, id)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = store.Lookup(ctx, id)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func testAddGet(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	defer store.Close()
+
+	urls := []string{"http://www.google.com", "http://www.yandex.ru", "http://www.mail.ru"}
+	ids := make([]string, len(urls))
+	for i, u := range urls {
+		id, _, err := store.Add(ctx, u, "")
+		require.NoError(t, err)
+		assert.NotEmpty(t, id)
+		ids[i] = id
+	}
+	for i, id := range ids {
+		url, err := store.Get(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, urls[i], url)
+		url, err = store.Lookup(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, urls[i], url)
+	}
+}
+
+func testDuplicates(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	defer store.Close()
+
+	i1, created, err := store.Add(ctx, "http://www.google.com", "")
+	require.NoError(t, err)
+	assert.True(t, created)
+	i2, created, err := store.Add(ctx, "http://www.yandex.ru", "")
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.NotEqual(t, i1, i2)
+
+	// Try to add a duplicate and check
+	//
+	id, created, err := store.Add(ctx, "http://www.google.com", "")
+	assert.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, i1, id)
+
+	// Full URLs differing in case only are not duplicates
+	//
+	id, created, err = store.Add(ctx, "http://www.Google.com", "")
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.NotEqual(t, i1, id)
+}
+
+func testBatch(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	defer store.Close()
+
+	i1, _, err := store.Add(ctx, "http://www.google.com", "")
+	require.NoError(t, err)
+
+	// Try to add a batch with new URLs, an existing one and a duplicate in the batch
+	//
+	urls := []string{"http://www.yandex.ru", "http://www.google.com", "http://www.mail.ru", "http://www.yandex.ru"}
+	ids, err := store.AddBatch(ctx, urls, "")
+	require.NoError(t, err)
+	require.Len(t, ids, len(urls))
+	assert.Equal(t, i1, ids[1])
+	assert.Equal(t, ids[0], ids[3])
+	assert.NotEqual(t, ids[0], ids[2])
+	assert.NotContains(t, []string{ids[0], ids[2]}, i1)
+	for i, id := range ids {
+		url, err := store.Get(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, urls[i], url)
+	}
+
+	// Duplicates of the batch URLs must get the same short URLs
+	//
+	id, created, err := store.Add(ctx, "http://www.mail.ru", "")
+	assert.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, ids[2], id)
+
+	ids, err = store.AddBatch(ctx, []string{}, "")
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+}
+
+func testListByOwner(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	defer store.Close()
+
+	links, err := store.ListByOwner(ctx, "user1", storage.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, links)
+
+	// The order the full URLs are added in differs from their sort order
+	//
+	urls := []string{"http://www.yandex.ru", "http://www.google.com", "http://www.mail.ru"}
+	var want []storage.Link
+	for _, u := range urls[:2] {
+		id, _, err := store.Add(ctx, u, "user1")
+		require.NoError(t, err)
+		want = append(want, storage.Link{Short: id, URL: u})
+	}
+	other, _, err := store.Add(ctx, "http://www.bing.com", "user2")
+	require.NoError(t, err)
+	ids, err := store.AddBatch(ctx, urls[2:], "user1")
+	require.NoError(t, err)
+	want = append(want, storage.Link{Short: ids[0], URL: urls[2]})
+
+	// Links added by someone else must not be listed, even if added once more
+	//
+	_, _, err = store.Add(ctx, "http://www.google.com", "user2")
+	require.NoError(t, err)
+	_, _, err = store.Add(ctx, "http://www.rambler.ru", "")
+	require.NoError(t, err)
+	links, err = store.ListByOwner(ctx, "user2", storage.ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Link{{Short: other, URL: "http://www.bing.com"}}, links)
+	links, err = store.ListByOwner(ctx, "", storage.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, links)
+
+	// The order the links have been added in by default
+	//
+	links, err = store.ListByOwner(ctx, "user1", storage.ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, want, links)
+	links, err = store.ListByOwner(ctx, "user1", storage.ListOptions{SortBy: storage.SortCreated, Desc: true})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Link{want[2], want[1], want[0]}, links)
+
+	// Other sort orders
+	//
+	links, err = store.ListByOwner(ctx, "user1", storage.ListOptions{SortBy: storage.SortURL})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Link{want[1], want[2], want[0]}, links)
+	links, err = store.ListByOwner(ctx, "user1", storage.ListOptions{SortBy: storage.SortShort, Desc: true})
+	require.NoError(t, err)
+	sorted := append([]storage.Link{}, want...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Short > sorted[j].Short })
+	assert.Equal(t, sorted, links)
+
+	// Pages
+	//
+	links, err = store.ListByOwner(ctx, "user1", storage.ListOptions{Offset: 1, Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, want[1:2], links)
+	links, err = store.ListByOwner(ctx, "user1", storage.ListOptions{Offset: 1})
+	require.NoError(t, err)
+	assert.Equal(t, want[1:], links)
+	links, err = store.ListByOwner(ctx, "user1", storage.ListOptions{Limit: 5})
+	require.NoError(t, err)
+	assert.Equal(t, want, links)
+	links, err = store.ListByOwner(ctx, "user1", storage.ListOptions{Offset: 3})
+	require.NoError(t, err)
+	assert.Empty(t, links)
+
+	// Invalid options
+	//
+	_, err = store.ListByOwner(ctx, "user1", storage.ListOptions{SortBy: "owner"})
+	assert.Error(t, err)
+	_, err = store.ListByOwner(ctx, "user1", storage.ListOptions{Offset: -1})
+	assert.Error(t, err)
+}
+
+func testDeleteBatch(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	defer store.Close()
+
+	urls := []string{"http://www.google.com", "http://www.yandex.ru", "http://www.mail.ru"}
+	ids, err := store.AddBatch(ctx, urls, "user1")
+	require.NoError(t, err)
+	other, _, err := store.Add(ctx, "http://www.bing.com", "user2")
+	require.NoError(t, err)
+	anonymous, _, err := store.Add(ctx, "http://www.rambler.ru", "")
+	require.NoError(t, err)
+
+	// Links of other owners, unowned and missing ones are skipped
+	//
+	err = store.DeleteBatch(ctx, []string{ids[0], other, anonymous, "0", ids[2], ids[0]}, "user1")
+	require.NoError(t, err)
+	err = store.DeleteBatch(ctx, []string{anonymous}, "")
+	require.NoError(t, err)
+	for _, id := range []string{ids[0], ids[2]} {
+		_, err = store.Get(ctx, id)
+		assert.ErrorIs(t, err, storage.ErrDeleted)
+		_, err = store.Lookup(ctx, id)
+		assert.ErrorIs(t, err, storage.ErrDeleted)
+	}
+	for _, id := range []string{ids[1], other, anonymous} {
+		_, err = store.Get(ctx, id)
+		assert.NoError(t, err)
+	}
+	_, err = store.Get(ctx, "0")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// Deleted links are not listed, and deleting them again does nothing
+	//
+	links, err := store.ListByOwner(ctx, "user1", storage.ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Link{{Short: ids[1], URL: urls[1]}}, links)
+	err = store.DeleteBatch(ctx, []string{ids[0]}, "user1")
+	assert.NoError(t, err)
+
+	// Adding a deleted full URL restores its short URL for the new owner, as a new one
+	//
+	id, created, err := store.Add(ctx, urls[0], "user2")
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, ids[0], id)
+	url, err := store.Get(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, urls[0], url)
+	links, err = store.ListByOwner(ctx, "user2", storage.ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Link{{Short: other, URL: "http://www.bing.com"}, {Short: ids[0], URL: urls[0]}}, links)
+	restored, err := store.AddBatch(ctx, []string{urls[2], urls[2]}, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{ids[2], ids[2]}, restored)
+	links, err = store.ListByOwner(ctx, "user1", storage.ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Link{{Short: ids[1], URL: urls[1]}, {Short: ids[2], URL: urls[2]}}, links)
+
+	// The former owner can no longer delete it
+	//
+	err = store.DeleteBatch(ctx, []string{ids[0]}, "user1")
+	require.NoError(t, err)
+	_, err = store.Get(ctx, ids[0])
+	assert.NoError(t, err)
+}
+
+func testAddAlias(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	defer store.Close()
+
+	id, _, err := store.Add(ctx, "http://www.google.com", "user1")
+	require.NoError(t, err)
+
+	// A full URL may have aliases along with its own short URL
+	//
+	require.NoError(t, addAlias(ctx, t, store, "spring-sale", "http://www.google.com", "user1"))
+	require.NoError(t, addAlias(ctx, t, store, "summer-sale", "http://www.google.com", "user2"))
+	require.NoError(t, addAlias(ctx, t, store, "yandex", "http://www.yandex.ru", ""))
+	for alias, u := range map[string]string{"spring-sale": "http://www.google.com", "summer-sale": "http://www.google.com", "yandex": "http://www.yandex.ru", id: "http://www.google.com"} {
+		url, err := store.Get(ctx, alias)
+		assert.NoError(t, err)
+		assert.Equal(t, u, url)
+	}
+	again, created, err := store.Add(ctx, "http://www.google.com", "")
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, id, again)
+	yandex, created, err := store.Add(ctx, "http://www.yandex.ru", "")
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.NotEqual(t, "yandex", yandex)
+	links, err := store.ListByOwner(ctx, "user1", storage.ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Link{{Short: id, URL: "http://www.google.com"}, {Short: "spring-sale", URL: "http://www.google.com"}}, links)
+
+	// Taken aliases and short URLs are conflicts, even for the same full URL
+	//
+	err = addAlias(ctx, t, store, "spring-sale", "http://www.mail.ru", "user1")
+	assert.ErrorIs(t, err, storage.ErrConflict)
+	err = addAlias(ctx, t, store, "spring-sale", "http://www.google.com", "user1")
+	assert.ErrorIs(t, err, storage.ErrConflict)
+	err = addAlias(ctx, t, store, id, "http://www.google.com", "user1")
+	assert.ErrorIs(t, err, storage.ErrConflict)
+
+	// A deleted alias is restored for the same full URL only
+	//
+	require.NoError(t, store.DeleteBatch(ctx, []string{"spring-sale"}, "user1"))
+	_, err = store.Get(ctx, "spring-sale")
+	assert.ErrorIs(t, err, storage.ErrDeleted)
+	err = addAlias(ctx, t, store, "spring-sale", "http://www.mail.ru", "user2")
+	assert.ErrorIs(t, err, storage.ErrConflict)
+	require.NoError(t, addAlias(ctx, t, store, "spring-sale", "http://www.google.com", "user2"))
+	url, err := store.Get(ctx, "spring-sale")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://www.google.com", url)
+	links, err = store.ListByOwner(ctx, "user2", storage.ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Link{{Short: "summer-sale", URL: "http://www.google.com"}, {Short: "spring-sale", URL: "http://www.google.com"}}, links)
+
+	// Deleted short URLs are not aliases, and adding their full URLs does not restore
+	// deleted aliases
+	//
+	require.NoError(t, store.DeleteBatch(ctx, []string{id, "spring-sale"}, "user2"))
+	require.NoError(t, store.DeleteBatch(ctx, []string{id}, "user1"))
+	err = addAlias(ctx, t, store, id, "http://www.google.com", "user1")
+	assert.ErrorIs(t, err, storage.ErrConflict)
+	again, created, err = store.Add(ctx, "http://www.google.com", "user1")
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, id, again)
+	_, err = store.Get(ctx, "spring-sale")
+	assert.ErrorIs(t, err, storage.ErrDeleted)
+}
+
+func testExpiry(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	defer store.Close()
+
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	expired, created, err := store.AddWithOptions(ctx, "http://www.google.com", "user1", storage.AddOptions{ExpiresAt: past})
+	require.NoError(t, err)
+	assert.True(t, created)
+	active, _, err := store.AddWithOptions(ctx, "http://www.yandex.ru", "user1", storage.AddOptions{ExpiresAt: future})
+	require.NoError(t, err)
+	limited, _, err := store.AddWithOptions(ctx, "http://www.mail.ru", "user1", storage.AddOptions{MaxClicks: 2})
+	require.NoError(t, err)
+	_, _, err = store.AddWithOptions(ctx, "http://www.bing.com", "user1", storage.AddOptions{Alias: "campaign", ExpiresAt: past})
+	require.NoError(t, err)
+
+	// Links stop working once they expire by the time or by the number of clicks, and
+	// lookups do not count as clicks
+	//
+	_, err = store.Get(ctx, expired)
+	assert.ErrorIs(t, err, storage.ErrExpired)
+	_, err = store.Lookup(ctx, expired)
+	assert.ErrorIs(t, err, storage.ErrExpired)
+	for i := 0; i < 3; i++ {
+		url, err := store.Lookup(ctx, limited)
+		assert.NoError(t, err)
+		assert.Equal(t, "http://www.mail.ru", url)
+	}
+	_, err = store.Get(ctx, "campaign")
+	assert.ErrorIs(t, err, storage.ErrExpired)
+	url, err := store.Get(ctx, active)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://www.yandex.ru", url)
+	for i := 0; i < 2; i++ {
+		url, err = store.Get(ctx, limited)
+		assert.NoError(t, err)
+		assert.Equal(t, "http://www.mail.ru", url)
+	}
+	_, err = store.Get(ctx, limited)
+	assert.ErrorIs(t, err, storage.ErrExpired)
+
+	// Expired links are restored as new ones with the new options, while the options of
+	// the existing ones stay the same
+	//
+	id, created, err := store.AddWithOptions(ctx, "http://www.google.com", "user2", storage.AddOptions{MaxClicks: 1})
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, expired, id)
+	id, created, err = store.AddWithOptions(ctx, "http://www.google.com", "user2", storage.AddOptions{ExpiresAt: past})
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, expired, id)
+	url, err = store.Get(ctx, expired)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://www.google.com", url)
+	_, err = store.Get(ctx, expired)
+	assert.ErrorIs(t, err, storage.ErrExpired)
+	err = addAlias(ctx, t, store, "campaign", "http://www.rambler.ru", "user2")
+	assert.ErrorIs(t, err, storage.ErrConflict)
+
+	// Purged links are gone along with their owners, and their short URLs become free
+	//
+	n, err := store.PurgeExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	for _, id := range []string{expired, limited, "campaign"} {
+		_, err = store.Get(ctx, id)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	}
+	links, err := store.ListByOwner(ctx, "user1", storage.ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Link{{Short: active, URL: "http://www.yandex.ru"}}, links)
+	require.NoError(t, addAlias(ctx, t, store, "campaign", "http://www.rambler.ru", "user2"))
+	id, created, err = store.Add(ctx, "http://www.mail.ru", "")
+	require.NoError(t, err)
+	assert.True(t, created)
+	url, err = store.Get(ctx, id)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://www.mail.ru", url)
+	n, err = store.PurgeExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func testStats(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	defer store.Close()
+
+	i1, _, err := store.Add(ctx, "http://www.google.com", "user1")
+	require.NoError(t, err)
+	i2, _, err := store.Add(ctx, "http://www.yandex.ru", "user1")
+	require.NoError(t, err)
+	limited, _, err := store.AddWithOptions(ctx, "http://www.mail.ru", "user1", storage.AddOptions{MaxClicks: 1})
+	require.NoError(t, err)
+
+	// Links without clicks have empty statistics, and missing ones have none
+	//
+	stats, err := store.Stats(ctx, i1, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, storage.Stats{Days: map[string]int64{}, Referrers: map[string]int64{}}, stats)
+	_, err = store.Stats(ctx, "missing", "user1")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// Statistics are only given to the owners
+	//
+	_, err = store.Stats(ctx, i1, "user2")
+	assert.ErrorIs(t, err, storage.ErrForbidden)
+	_, err = store.Stats(ctx, i1, "")
+	assert.ErrorIs(t, err, storage.ErrForbidden)
+
+	// Clicks are counted by UTC dates and referrers, and the ones of missing short URLs
+	// are skipped
+	//
+	day1 := time.Date(2023, 3, 1, 23, 30, 0, 0, time.FixedZone("UTC-1", -3600))
+	day2 := time.Date(2023, 3, 3, 0, 30, 0, 0, time.UTC)
+	require.NoError(t, store.AddClicks(ctx, []storage.Click{
+		{Short: i1, Time: day1, Referrer: "yandex.ru", UserAgent: "curl/7.88.1", IPHash: "a"},
+		{Short: i1, Time: day2, Referrer: "yandex.ru", UserAgent: "curl/7.88.1", IPHash: "b"},
+		{Short: "missing", Time: day2},
+		{Short: i2, Time: day2},
+	}))
+	require.NoError(t, store.AddClicks(ctx, []storage.Click{{Short: i1, Time: day2, Referrer: "", IPHash: "a"}}))
+	require.NoError(t, store.AddClicks(ctx, nil))
+	stats, err = store.Stats(ctx, i1, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, storage.Stats{
+		Total:     3,
+		Days:      map[string]int64{"2023-03-02": 1, "2023-03-03": 2},
+		Referrers: map[string]int64{"yandex.ru": 2, "": 1},
+	}, stats)
+	stats, err = store.Stats(ctx, i2, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Total)
+	_, err = store.Stats(ctx, "missing", "user1")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// Statistics stay while the links are deleted or expired, and are gone once the
+	// links are purged
+	//
+	require.NoError(t, store.AddClicks(ctx, []storage.Click{{Short: limited, Time: day2}}))
+	_, err = store.Get(ctx, limited)
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteBatch(ctx, []string{i2}, "user1"))
+	stats, err = store.Stats(ctx, i2, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Total)
+	stats, err = store.Stats(ctx, limited, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Total)
+	n, err := store.PurgeExpired(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = store.Stats(ctx, limited, "user1")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	id, _, err := store.Add(ctx, "http://www.mail.ru", "user1")
+	require.NoError(t, err)
+	stats, err = store.Stats(ctx, id, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), stats.Total)
+}
+
+// testRestore() checks that deleted and expired links restored for another owner are
+// new ones, which have nothing of the former links
+
+func testRestore(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+
+	i1, _, err := store.Add(ctx, "http://www.google.com", "user1")
+	require.NoError(t, err)
+	require.NoError(t, addAlias(ctx, t, store, "spring-sale", "http://www.yandex.ru", "user1"))
+	limited, _, err := store.AddWithOptions(ctx, "http://www.mail.ru", "user1", storage.AddOptions{MaxClicks: 1})
+	require.NoError(t, err)
+	_, err = store.Get(ctx, limited)
+	require.NoError(t, err)
+	shorts := []string{i1, "spring-sale", limited}
+	for _, short := range shorts {
+		require.NoError(t, store.AddClicks(ctx, []storage.Click{{Short: short, Time: time.Now(), Referrer: "yandex.ru"}}))
+	}
+	require.NoError(t, store.Update(ctx, "spring-sale", "http://www.bing.com", "user1"))
+	require.NoError(t, store.Update(ctx, "spring-sale", "http://www.yandex.ru", "user1"))
+	require.NoError(t, store.DeleteBatch(ctx, []string{i1, "spring-sale"}, "user1"))
+
+	id, created, err := store.Add(ctx, "http://www.google.com", "user2")
+	require.NoError(t, err)
+	assert.Equal(t, i1, id)
+	assert.True(t, created)
+	require.NoError(t, addAlias(ctx, t, store, "spring-sale", "http://www.yandex.ru", "user2"))
+	id, created, err = store.Add(ctx, "http://www.mail.ru", "user2")
+	require.NoError(t, err)
+	assert.Equal(t, limited, id)
+	assert.True(t, created)
+
+	// The same holds after the reopen, if the store is persistent
+	//
+	check := func() {
+		for _, short := range shorts {
+			stats, err := store.Stats(ctx, short, "user2")
+			require.NoError(t, err)
+			assert.Equal(t, storage.Stats{Days: map[string]int64{}, Referrers: map[string]int64{}}, stats, short)
+		}
+		revisions, err := store.History(ctx, "spring-sale", "user2")
+		require.NoError(t, err)
+		assert.Equal(t, []storage.Revision{{Version: 1, URL: "http://www.yandex.ru"}}, revisions)
+	}
+	check()
+	require.NoError(t, store.Close())
+	store, err = open()
+	require.NoError(t, err)
+	if store == nil {
+		return
+	}
+	defer store.Close()
+	check()
+}
+
+func testUpdate(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	defer store.Close()
+
+	i1, _, err := store.Add(ctx, "http://www.google.com", "user1")
+	require.NoError(t, err)
+	i2, _, err := store.Add(ctx, "http://www.yandex.ru", "user1")
+	require.NoError(t, err)
+	unowned, _, err := store.Add(ctx, "http://www.mail.ru", "")
+	require.NoError(t, err)
+
+	// Only the owner may change the full URL
+	//
+	err = store.Update(ctx, i1, "http://www.bing.com", "user2")
+	assert.ErrorIs(t, err, storage.ErrForbidden)
+	err = store.Update(ctx, unowned, "http://www.bing.com", "")
+	assert.ErrorIs(t, err, storage.ErrForbidden)
+	err = store.Update(ctx, "missing", "http://www.bing.com", "user1")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	_, err = store.History(ctx, i1, "user2")
+	assert.ErrorIs(t, err, storage.ErrForbidden)
+	_, err = store.History(ctx, "missing", "user1")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	revisions, err := store.History(ctx, i1, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Revision{{Version: 1, URL: "http://www.google.com"}}, revisions)
+
+	// The full URL may be the one of another short URL, and changing it to the same one
+	// makes no new version
+	//
+	before := time.Now()
+	require.NoError(t, store.Update(ctx, i1, "http://www.bing.com", "user1"))
+	require.NoError(t, store.Update(ctx, i1, "http://www.yandex.ru", "user1"))
+	require.NoError(t, store.Update(ctx, i1, "http://www.yandex.ru", "user1"))
+	url, err := store.Get(ctx, i1)
+	require.NoError(t, err)
+	assert.Equal(t, "http://www.yandex.ru", url)
+	revisions, err = store.History(ctx, i1, "user1")
+	require.NoError(t, err)
+	require.Len(t, revisions, 3)
+	for i, url := range []string{"http://www.google.com", "http://www.bing.com", "http://www.yandex.ru"} {
+		assert.Equal(t, int64(i+1), revisions[i].Version)
+		assert.Equal(t, url, revisions[i].URL)
+	}
+	assert.WithinDuration(t, before, revisions[0].ReplacedAt, time.Minute)
+	assert.False(t, revisions[1].ReplacedAt.Before(revisions[0].ReplacedAt))
+	assert.True(t, revisions[2].ReplacedAt.IsZero())
+
+	// The changed short URL is no longer the one of any full URL, and it keeps its place
+	// in the list
+	//
+	id, created, err := store.Add(ctx, "http://www.google.com", "user1")
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.NotEqual(t, i1, id)
+	id, created, err = store.Add(ctx, "http://www.yandex.ru", "user1")
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, i2, id)
+	links, err := store.ListByOwner(ctx, "user1", storage.ListOptions{Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Link{{Short: i1, URL: "http://www.yandex.ru"}, {Short: i2, URL: "http://www.yandex.ru"}}, links)
+
+	// Deleted and expired links may not be changed, but the history stays until they
+	// are purged
+	//
+	require.NoError(t, store.DeleteBatch(ctx, []string{i1}, "user1"))
+	err = store.Update(ctx, i1, "http://www.rambler.ru", "user1")
+	assert.ErrorIs(t, err, storage.ErrDeleted)
+	revisions, err = store.History(ctx, i1, "user1")
+	require.NoError(t, err)
+	assert.Len(t, revisions, 3)
+	limited, _, err := store.AddWithOptions(ctx, "http://www.rambler.ru", "user1", storage.AddOptions{MaxClicks: 1})
+	require.NoError(t, err)
+	require.NoError(t, store.Update(ctx, limited, "http://www.rambler.ru/new", "user1"))
+	_, err = store.Get(ctx, limited)
+	require.NoError(t, err)
+	err = store.Update(ctx, limited, "http://www.rambler.ru/newer", "user1")
+	assert.ErrorIs(t, err, storage.ErrExpired)
+	revisions, err = store.History(ctx, limited, "user1")
+	require.NoError(t, err)
+	assert.Len(t, revisions, 2)
+	_, err = store.PurgeExpired(ctx)
+	require.NoError(t, err)
+	_, err = store.History(ctx, limited, "user1")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	require.NoError(t, addAlias(ctx, t, store, limited, "http://www.rambler.ru/new", "user1"))
+	revisions, err = store.History(ctx, limited, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Revision{{Version: 1, URL: "http://www.rambler.ru/new"}}, revisions)
+}
+
+func testKeys(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	defer store.Close()
+
+	_, err := store.GetKey(ctx, "missing")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	keys, err := store.ListKeys(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	// Keys are found by the hashes, and listed in the order of creation
+	//
+	now := time.Now().Truncate(time.Millisecond)
+	k1 := storage.APIKey{ID: "id1", Hash: "hash1", Owner: "user1", Scope: "create", CreatedAt: now.Add(time.Second)}
+	k2 := storage.APIKey{ID: "id2", Hash: "hash2", Owner: "user2", Scope: "admin", CreatedAt: now}
+	require.NoError(t, store.AddKey(ctx, k1))
+	require.NoError(t, store.AddKey(ctx, k2))
+	key, err := store.GetKey(ctx, "hash1")
+	require.NoError(t, err)
+	assertKey(t, k1, key)
+	keys, err = store.ListKeys(ctx)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assertKey(t, k2, keys[0])
+	assertKey(t, k1, keys[1])
+
+	// Neither the ID nor the hash may be taken twice
+	//
+	err = store.AddKey(ctx, storage.APIKey{ID: "id1", Hash: "hash3", Owner: "user1", Scope: "create", CreatedAt: now})
+	assert.ErrorIs(t, err, storage.ErrConflict)
+	err = store.AddKey(ctx, storage.APIKey{ID: "id3", Hash: "hash1", Owner: "user1", Scope: "create", CreatedAt: now})
+	assert.ErrorIs(t, err, storage.ErrConflict)
+
+	// Revoked keys are still found, but marked so
+	//
+	assert.ErrorIs(t, store.RevokeKey(ctx, "missing"), storage.ErrNotFound)
+	require.NoError(t, store.RevokeKey(ctx, "id1"))
+	require.NoError(t, store.RevokeKey(ctx, "id1"))
+	key, err = store.GetKey(ctx, "hash1")
+	require.NoError(t, err)
+	assert.True(t, key.Revoked)
+	key, err = store.GetKey(ctx, "hash2")
+	require.NoError(t, err)
+	assert.False(t, key.Revoked)
+}
+
+// assertKey() compares the keys, the creation times only up to milliseconds
+
+func assertKey(t *testing.T, want, got storage.APIKey) {
+	assert.True(t, want.CreatedAt.Equal(got.CreatedAt), "created at %v, want %v", got.CreatedAt, want.CreatedAt)
+	want.CreatedAt, got.CreatedAt = time.Time{}, time.Time{}
+	assert.Equal(t, want, got)
+}
+
+func testConcurrency(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	defer store.Close()
+
+	// Hammer the store from many goroutines, each one adding a few URLs shared with the
+	// others, and reading them back. Run with -race to detect data races.
+	//
+	const workers, urls = 8, 25
+	ids := make([][]string, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			ids[w] = make([]string, urls)
+			for i := 0; i < urls; i++ {
+				u := fmt.Sprintf("http://www.google.com/%d", i)
+				id, _, err := store.Add(ctx, u, "")
+				if !assert.NoError(t, err) {
+					return
+				}
+				ids[w][i] = id
+				url, err := store.Get(ctx, id)
+				assert.NoError(t, err)
+				assert.Equal(t, u, url)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// All goroutines must have got the same short URLs for the same full URLs
+	//
+	for w := 1; w < workers; w++ {
+		assert.Equal(t, ids[0], ids[w])
+	}
+}
+
+func testPing(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	defer store.Close()
+	assert.NoError(t, store.Ping(ctx))
+	_, _, err := store.Add(ctx, "http://www.google.com", "")
+	require.NoError(t, err)
+	assert.NoError(t, store.Ping(ctx))
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.ErrorIs(t, store.Ping(ctx), context.Canceled)
+}
+
+func testClose(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	short, _, err := store.Add(ctx, "http://www.google.com", "user1")
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	_, _, err = store.Add(ctx, "http://www.yandex.ru", "")
+	assert.ErrorIs(t, err, storage.ErrUnavailable)
+	_, err = store.Get(ctx, short)
+	assert.ErrorIs(t, err, storage.ErrUnavailable)
+	_, err = store.ListByOwner(ctx, "user1", storage.ListOptions{})
+	assert.ErrorIs(t, err, storage.ErrUnavailable)
+	assert.ErrorIs(t, store.Ping(ctx), storage.ErrUnavailable)
+
+	store, err = open()
+	require.NoError(t, err)
+	if store == nil {
+		t.Skip("the store is not persistent")
+	}
+	defer store.Close()
+	url, err := store.Get(ctx, short)
+	require.NoError(t, err)
+	assert.Equal(t, "http://www.google.com", url)
+}
+
+func testPersistence(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	i1, _, err := store.Add(ctx, "http://www.google.com", "user2")
+	require.NoError(t, err)
+	i2, _, err := store.Add(ctx, "http://www.yandex.ru", "")
+	require.NoError(t, err)
+	batch := []string{"http://www.mail.ru/1", "http://www.mail.ru/2"}
+	ids, err := store.AddBatch(ctx, batch, "user1")
+	require.NoError(t, err)
+	i4, _, err := store.Add(ctx, "http://www.bing.com", "user1")
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteBatch(ctx, []string{i4}, "user1"))
+	require.NoError(t, addAlias(ctx, t, store, "bing", "http://www.bing.com", "user1"))
+	limited, _, err := store.AddWithOptions(ctx, "http://www.rambler.ru", "", storage.AddOptions{ExpiresAt: time.Now().Add(time.Hour), MaxClicks: 2})
+	require.NoError(t, err)
+	_, err = store.Get(ctx, limited)
+	require.NoError(t, err)
+	day := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, store.AddClicks(ctx, []storage.Click{{Short: i1, Time: day, Referrer: "yandex.ru"}}))
+	require.NoError(t, store.AddClicks(ctx, []storage.Click{{Short: i1, Time: day}}))
+	require.NoError(t, store.Update(ctx, ids[0], "http://www.mail.ru/3", "user1"))
+	apiKey := storage.APIKey{ID: "id1", Hash: "hash1", Owner: "user1", Scope: "create", CreatedAt: time.Now().Truncate(time.Millisecond)}
+	require.NoError(t, store.AddKey(ctx, apiKey))
+	require.NoError(t, store.AddKey(ctx, storage.APIKey{ID: "id2", Hash: "hash2", Owner: "user1", Scope: "admin", CreatedAt: apiKey.CreatedAt}))
+	require.NoError(t, store.RevokeKey(ctx, "id2"))
+	links, err := store.ListByOwner(ctx, "user1", storage.ListOptions{})
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	store, err = open()
+	require.NoError(t, err)
+	if store == nil {
+		t.Skip("the store is not persistent")
+	}
+	defer store.Close()
+
+	url, err := store.Get(ctx, i1)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://www.google.com", url)
+	url, err = store.Get(ctx, i2)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://www.yandex.ru", url)
+	url, err = store.Get(ctx, ids[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "http://www.mail.ru/3", url)
+	url, err = store.Get(ctx, ids[1])
+	assert.NoError(t, err)
+	assert.Equal(t, batch[1], url)
+	revisions, err := store.History(ctx, ids[0], "user1")
+	assert.NoError(t, err)
+	require.Len(t, revisions, 2)
+	assert.Equal(t, batch[0], revisions[0].URL)
+	assert.Equal(t, "http://www.mail.ru/3", revisions[1].URL)
+	key, err := store.GetKey(ctx, "hash1")
+	assert.NoError(t, err)
+	assertKey(t, apiKey, key)
+	key, err = store.GetKey(ctx, "hash2")
+	assert.NoError(t, err)
+	assert.True(t, key.Revoked)
+	again, err := store.ListByOwner(ctx, "user1", storage.ListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, links, again)
+	_, err = store.Get(ctx, i4)
+	assert.ErrorIs(t, err, storage.ErrDeleted)
+	err = addAlias(ctx, t, store, "bing", "http://www.bing.com", "user1")
+	assert.ErrorIs(t, err, storage.ErrConflict)
+	stats, err := store.Stats(ctx, i1, "user2")
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Stats{
+		Total:     2,
+		Days:      map[string]int64{"2023-03-01": 2},
+		Referrers: map[string]int64{"yandex.ru": 1, "": 1},
+	}, stats)
+
+	// Clicks of links with limited clicks are counted across reopens
+	//
+	_, err = store.Get(ctx, limited)
+	assert.NoError(t, err)
+	_, err = store.Get(ctx, limited)
+	assert.ErrorIs(t, err, storage.ErrExpired)
+
+	// Duplicates must be detected after reopen as well
+	//
+	id, created, err := store.Add(ctx, "http://www.google.com", "")
+	assert.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, i1, id)
+	i3, _, err := store.Add(ctx, "http://www.mail.ru", "")
+	assert.NoError(t, err)
+	assert.NotContains(t, append([]string{i1, i2}, ids...), i3)
+}
+
+// testReopen() adds many links, so a generator starting anew after the reopen would
+// have to skip all of them (or give up) to add the next one
+
+func testReopen(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	urls := make([]string, 1500)
+	ids := make([]string, len(urls))
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://www.google.com/%d", i)
+		id, _, err := store.Add(ctx, urls[i], "")
+		require.NoError(t, err)
+		ids[i] = id
+	}
+	require.NoError(t, store.Close())
+
+	store, err := open()
+	require.NoError(t, err)
+	if store == nil {
+		t.Skip("the store is not persistent")
+	}
+	defer store.Close()
+
+	id, created, err := store.Add(ctx, "http://www.yandex.ru", "")
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.NotContains(t, ids, id)
+	url, err := store.Get(ctx, ids[0])
+	assert.NoError(t, err)
+	assert.Equal(t, urls[0], url)
+}
+
+func testLargeData(t *testing.T, open Opener) {
+	ctx := context.Background()
+	store := openStore(t, open)
+	defer store.Close()
+
+	// Long full URLs and the ones with special characters
+	//
+	urls := []string{
+		"http://www.google.com/" + strings.Repeat("a", 64*1024),
+		"http://www.google.com/search?q=a b\tc\nd",
+		"http://www.яндекс.рф/путь?q=\"значение\"",
+		"http://www.google.com/\\/%00",
+	}
+
+	// Many records
+	//
+	n := 2000
+	if testing.Short() {
+		n = 200
+	}
+	for i := 0; i < n; i++ {
+		urls = append(urls, fmt.Sprintf("http://www.google.com/%d", i))
+	}
+
+	ids := make([]string, len(urls))
+	for i, u := range urls {
+		id, _, err := store.Add(ctx, u, "")
+		require.NoError(t, err)
+		ids[i] = id
+	}
+	for i, id := range ids {
+		url, err := store.Get(ctx, id)
+		require.NoError(t, err)
+		require.Equal(t, urls[i], url)
+	}
+}